@@ -12,6 +12,9 @@ import (
 	"github.com/OhanaFS/stitch/util"
 )
 
+// Overhead is the number of bytes added to each chunk by AES-GCM.
+const Overhead = 16
+
 var (
 	ErrInvalidKeyLength = errors.New("Key must be 16, 24, or 32 bytes long")
 )
@@ -279,3 +282,79 @@ func (r *AESReader) Read(p []byte) (int, error) {
 	r.cursor += int64(written)
 	return written, nil
 }
+
+// AESStreamReader reads data sequentially from an io.Reader that was generated
+// using AESWriter. Unlike AESReader, it does not require the underlying reader
+// to support seeking.
+type AESStreamReader struct {
+	ds        io.Reader
+	gcm       cipher.AEAD
+	chunkSize int
+	fileSize  uint64
+
+	// index is the index of the next chunk to be decrypted.
+	index int
+	// plaintext holds decrypted data that hasn't been returned yet.
+	plaintext []byte
+	// read is the number of plaintext bytes decrypted so far.
+	read uint64
+}
+
+// Assert that the AESStreamReader struct satisfies the io.Reader interface
+var _ io.Reader = &AESStreamReader{}
+
+// NewStreamReader creates a new AESStreamReader
+func NewStreamReader(ds io.Reader, key []byte, chunkSize int, fileSize uint64) (*AESStreamReader, error) {
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return nil, ErrInvalidKeyLength
+	}
+
+	// Create a new block cipher
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AESStreamReader{ds: ds, gcm: gcm, chunkSize: chunkSize, fileSize: fileSize}, nil
+}
+
+func (r *AESStreamReader) Read(p []byte) (int, error) {
+	if len(r.plaintext) == 0 {
+		if r.read >= r.fileSize {
+			return 0, io.EOF
+		}
+
+		// Read the next chunk
+		ciphertext := make([]byte, r.chunkSize+r.gcm.Overhead())
+		if _, err := io.ReadFull(r.ds, ciphertext); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		// Decrypt the chunk
+		nonce := make([]byte, r.gcm.NonceSize())
+		binary.BigEndian.PutUint64(nonce, uint64(r.index))
+		plaintext, err := r.gcm.Open(nil, nonce, ciphertext, nil)
+		if err != nil {
+			return 0, err
+		}
+		r.index++
+
+		// Drop the padding at the end of the last chunk
+		if r.read+uint64(len(plaintext)) > r.fileSize {
+			plaintext = plaintext[:r.fileSize-r.read]
+		}
+		r.read += uint64(len(plaintext))
+		r.plaintext = plaintext
+	}
+
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
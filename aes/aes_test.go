@@ -69,3 +69,34 @@ func TestAES(t *testing.T) {
 	assert.Equal(len(datatext)-int(midpoint), n)
 	assert.Equal(datatext[midpoint:], string(res[:midpoint]))
 }
+
+func TestAESStream(t *testing.T) {
+	assert := assert.New(t)
+
+	key := []byte("11111111aaaaaaaa")
+	buf := util.NewMembuf()
+
+	w, err := aes.NewWriter(buf, key, 8)
+	assert.NoError(err)
+	datatext := "test-1234-asdf-abcd-"
+	_, err = w.Write([]byte(datatext))
+	assert.NoError(err)
+	assert.NoError(w.Close())
+
+	// Read the data back in a single pass
+	buf.Seek(0, io.SeekStart)
+	r, err := aes.NewStreamReader(buf, key, 8, uint64(len(datatext)))
+	assert.NoError(err)
+	res, err := io.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(datatext, string(res))
+
+	// Tampered data should fail to decrypt
+	buf.Seek(0, io.SeekStart)
+	buf.Write([]byte("x"))
+	buf.Seek(0, io.SeekStart)
+	r, err = aes.NewStreamReader(buf, key, 8, uint64(len(datatext)))
+	assert.NoError(err)
+	_, err = io.ReadAll(r)
+	assert.Error(err)
+}
@@ -5,10 +5,13 @@ import (
 	"flag"
 	"io"
 	"log"
+	"net/http"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/OhanaFS/stitch"
+	"github.com/OhanaFS/stitch/metrics"
 	"github.com/OhanaFS/stitch/util"
 )
 
@@ -18,11 +21,29 @@ var (
 	bParityShards = BenchCmd.Int("parity-shards", 1, "number of parity shards")
 	bThreads      = BenchCmd.Int("threads", 1, "number of threads")
 	bInputSize    = BenchCmd.Int("input-size", 10*1024*1024, "size of input file")
+	bMetricsAddr  = BenchCmd.String("metrics-addr", "", "address to serve Prometheus metrics on while the benchmark runs, e.g. :9090 (no other command serves metrics)")
 )
 
 func RunBenchCmd() int {
 	log.Printf("Running benchmark with %d data shards, %d parity shards, and %d threads", *bDataShards, *bParityShards, *bThreads)
 
+	// Serve the metrics of the encoders while the benchmark runs, if
+	// requested.
+	var registry *metrics.Registry
+	if *bMetricsAddr != "" {
+		registry = metrics.NewRegistry()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry)
+		server := &http.Server{Addr: *bMetricsAddr, Handler: mux}
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatalln("Failed to serve metrics:", err)
+			}
+		}()
+		defer server.Close()
+		log.Printf("Serving metrics on %s/metrics", *bMetricsAddr)
+	}
+
 	runBench := func(dataShards, parityShards int) (time.Duration, time.Duration, error) {
 		// Create the inputs and outputs
 		input := &util.RandomReader{Size: int64(*bInputSize)}
@@ -37,11 +58,15 @@ func RunBenchCmd() int {
 		}
 
 		// Create the encoder
-		encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		opts := &stitch.EncoderOptions{
 			DataShards:   uint8(dataShards),
 			ParityShards: uint8(parityShards),
 			KeyThreshold: uint8(dataShards),
-		})
+		}
+		if registry != nil {
+			opts.Metrics = registry
+		}
+		encoder := stitch.NewEncoder(opts)
 
 		// Generate a key and IV
 		key := make([]byte, 32)
@@ -120,5 +145,13 @@ func RunBenchCmd() int {
 	log.Printf("Average encode: %v, speed: %s/s", averageEncode, util.FormatSize(speedEncode))
 	log.Printf("Average decode: %v, speed: %s/s", averageDecode, util.FormatSize(speedDecode))
 
+	// Print the final metrics, as they are no longer served once the command
+	// exits.
+	if registry != nil {
+		if _, err := registry.WriteTo(os.Stdout); err != nil {
+			log.Println("Failed to write metrics:", err)
+		}
+	}
+
 	return 0
 }
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/OhanaFS/stitch"
+	"github.com/OhanaFS/stitch/util"
+)
+
+var (
+	EstimateCmd  = flag.NewFlagSet("estimate", flag.ExitOnError)
+	eInputSize   = EstimateCmd.Uint64("input-size", 0, "size of the input file in bytes")
+	eRatio       = EstimateCmd.Float64("ratio", 1, "expected compressed size relative to the input, 1 for incompressible data")
+	eLayouts     = EstimateCmd.String("layouts", "2+1,3+2,4+2,6+3,10+4", "comma-separated data+parity shard layouts to compare")
+	ePadding     = EstimateCmd.String("padding", "none", "padding policy: none, pow2, padme or a multiple in bytes")
+	eKeepTrailer = EstimateCmd.Bool("keep-trailer", false, "keep a copy of the header at the end of each shard")
+	eStreaming   = EstimateCmd.Bool("streaming", false, "estimate shards written in streaming mode")
+)
+
+// parseLayout parses a layout in the form data+parity.
+func parseLayout(layout string) (uint8, uint8, error) {
+	data, parity, ok := strings.Cut(strings.TrimSpace(layout), "+")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid layout %q, expected data+parity", layout)
+	}
+	d, err := strconv.ParseUint(data, 10, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid number of data shards in %q", layout)
+	}
+	p, err := strconv.ParseUint(parity, 10, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid number of parity shards in %q", layout)
+	}
+	return uint8(d), uint8(p), nil
+}
+
+func RunEstimateCmd() int {
+	if *eInputSize == 0 {
+		log.Fatalln("You must specify the input size using -input-size.")
+	}
+
+	// Parse the padding policy.
+	opts := stitch.EncoderOptions{
+		KeepTrailer: *eKeepTrailer,
+		Streaming:   *eStreaming,
+	}
+	switch *ePadding {
+	case "none":
+	case "pow2":
+		opts.Padding = stitch.PaddingPowerOfTwo
+	case "padme":
+		opts.Padding = stitch.PaddingPadme
+	default:
+		multiple, err := strconv.ParseUint(*ePadding, 10, 64)
+		if err != nil || multiple == 0 {
+			log.Fatalf("Invalid padding policy: %s\n", *ePadding)
+		}
+		opts.Padding = stitch.PaddingMultiple
+		opts.PaddingMultiple = multiple
+	}
+
+	fmt.Printf("Input size: %s, compression ratio: %.2f\n",
+		util.FormatSize(int64(*eInputSize)), *eRatio)
+
+	// Print the estimate for each layout.
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Layout\tShard size\tPeak shard size\tTotal size\tOverhead\tTolerates\t")
+	for _, layout := range strings.Split(*eLayouts, ",") {
+		dataShards, parityShards, err := parseLayout(layout)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		opts.DataShards = dataShards
+		opts.ParityShards = parityShards
+		est, err := stitch.NewEncoder(&opts).EstimateShardSize(*eInputSize, *eRatio)
+		if err != nil {
+			log.Fatalf("Failed to estimate layout %s: %s\n", layout, err)
+		}
+
+		overhead := float64(est.TotalSize)/float64(*eInputSize)*100 - 100
+		fmt.Fprintf(w, "%d+%d\t%s\t%s\t%s\t%+.1f%%\t%d lost\t\n",
+			dataShards, parityShards,
+			util.FormatSize(est.ShardSize), util.FormatSize(est.PeakShardSize),
+			util.FormatSize(est.TotalSize), overhead, parityShards)
+	}
+	w.Flush()
+
+	return 0
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/OhanaFS/stitch/keyshare"
+)
+
+var (
+	KeycombineCmd = flag.NewFlagSet("keycombine", flag.ExitOnError)
+)
+
+func RunKeycombineCmd() int {
+	scanner := bufio.NewScanner(os.Stdin)
+
+	// Read shares until there are enough of them to recombine the key
+	var shares []*keyshare.Share
+	for len(shares) == 0 || len(shares) < shares[0].Threshold {
+		if len(shares) == 0 {
+			fmt.Fprintf(os.Stderr, "Enter share 1: ")
+		} else {
+			fmt.Fprintf(os.Stderr, "Enter share %d of %d: ",
+				len(shares)+1, shares[0].Threshold)
+		}
+		if !scanner.Scan() {
+			log.Fatalln("Not enough shares to recombine the key.")
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		// Decode and verify the share
+		share, err := keyshare.Decode(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid share, please try again: %s\n", err)
+			continue
+		}
+		if len(shares) > 0 && !bytes.Equal(share.Fingerprint, shares[0].Fingerprint) {
+			fmt.Fprintln(os.Stderr, "Share belongs to a different key, please try again.")
+			continue
+		}
+		duplicate := false
+		for _, s := range shares {
+			if bytes.Equal(s.Data, share.Data) {
+				duplicate = true
+			}
+		}
+		if duplicate {
+			fmt.Fprintln(os.Stderr, "Share was already entered, please try again.")
+			continue
+		}
+		shares = append(shares, share)
+	}
+
+	// Combine the shares, and verify the key against the fingerprint
+	key, err := keyshare.Combine(shares)
+	if err != nil {
+		log.Fatalln("Failed to combine shares:", err)
+	}
+
+	fmt.Println(hex.EncodeToString(key))
+	return 0
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/OhanaFS/stitch/keyshare"
+)
+
+var (
+	KeysplitCmd = flag.NewFlagSet("keysplit", flag.ExitOnError)
+	ksShares    = KeysplitCmd.Int("shares", 5, "number of shares to create")
+	ksThreshold = KeysplitCmd.Int("threshold", 3, "number of shares required to recombine the key")
+	ksFormat    = KeysplitCmd.String("format", "words", "output format, either hex or words")
+)
+
+func RunKeysplitCmd() int {
+	// Read the master key from stdin, rather than from the command line, where
+	// it would be visible to other users.
+	line, err := readSecret(bufio.NewScanner(os.Stdin), "Enter the key to split, in hex: ")
+	if err != nil {
+		log.Fatalln("Failed to read key:", err)
+	}
+	key, err := hex.DecodeString(line)
+	if err != nil || len(key) == 0 {
+		log.Fatalln("Invalid key, expected hex.")
+	}
+
+	// Split the key
+	shares, err := keyshare.Split(key, *ksShares, *ksThreshold)
+	if err != nil {
+		log.Fatalln("Failed to split key:", err)
+	}
+
+	// Print the shares
+	for i, share := range shares {
+		text, err := keyshare.Encode(share, *ksFormat)
+		if err != nil {
+			log.Fatalln("Failed to encode share:", err)
+		}
+		fmt.Printf("Share %d of %d:\n%s\n\n", i+1, *ksShares, text)
+	}
+
+	fmt.Printf("Any %d of the %d shares can be used to recombine the key.\n",
+		*ksThreshold, *ksShares)
+	return 0
+}
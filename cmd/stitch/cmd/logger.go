@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/OhanaFS/stitch"
+)
+
+// cliLogger writes the events of the encoder to the standard logger, as the
+// message followed by key=value pairs.
+type cliLogger struct{}
+
+// Assert that cliLogger satisfies the stitch.Logger interface.
+var _ stitch.Logger = cliLogger{}
+
+func (cliLogger) Debug(msg string, args ...any) { logEvent("DEBUG", msg, args) }
+func (cliLogger) Info(msg string, args ...any)  { logEvent("INFO", msg, args) }
+func (cliLogger) Warn(msg string, args ...any)  { logEvent("WARN", msg, args) }
+func (cliLogger) Error(msg string, args ...any) { logEvent("ERROR", msg, args) }
+
+func logEvent(level, msg string, args []any) {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	log.Printf("[%s] %s", level, b.String())
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/OhanaFS/stitch"
+)
+
+var MigrateCmd = flag.NewFlagSet("migrate", flag.ExitOnError)
+
+func RunMigrateCmd() int {
+	shardNames := MigrateCmd.Args()
+	if len(shardNames) == 0 {
+		log.Fatalln("You must specify the shard files to migrate.")
+	}
+
+	// The encoder options don't matter for migrations.
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{})
+
+	migrated, upToDate, failed := 0, 0, 0
+	var reencode []string
+	for _, name := range shardNames {
+		shardFile, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			log.Printf("Failed to open shard %s: %s\n", name, err)
+			failed++
+			continue
+		}
+
+		res, err := encoder.MigrateHeader(shardFile)
+		shardFile.Close()
+		if err != nil {
+			log.Printf("Failed to migrate shard %s: %s\n", name, err)
+			failed++
+			continue
+		}
+
+		if res.Migrated {
+			fmt.Printf("%s: migrated from version %d\n", name, res.FromVersion)
+			migrated++
+		} else {
+			upToDate++
+		}
+		if res.NeedsReencode {
+			reencode = append(reencode, name)
+		}
+	}
+
+	fmt.Printf("%d migrated, %d already up to date, %d failed\n",
+		migrated, upToDate, failed)
+	if len(reencode) > 0 {
+		fmt.Println("The following shards need to be re-encoded:")
+		for _, name := range reencode {
+			fmt.Printf("  %s\n", name)
+		}
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -1,16 +1,19 @@
 package cmd
 
 import (
+	"context"
 	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"os"
+	"path/filepath"
 	"strconv"
 
 	"github.com/OhanaFS/stitch"
-	"github.com/OhanaFS/stitch/util"
+	"github.com/OhanaFS/stitch/header"
 )
 
 var (
@@ -45,11 +48,14 @@ func RunPipelineCmd() int {
 	}
 
 	// Create the encoder
-	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+	opts := &stitch.EncoderOptions{
 		DataShards:   uint8(*plDataShards),
 		ParityShards: uint8(*plParityShards),
 		KeyThreshold: uint8(*plDataShards),
-	})
+		Progress:     progressFunc(),
+		Logger:       cliLogger{},
+	}
+	encoder := stitch.NewEncoder(opts)
 
 	// Get key and IV
 	key, err := hex.DecodeString(*plFileKey)
@@ -83,19 +89,25 @@ func RunPipelineCmd() int {
 			shardFiles[i] = shardFile
 		}
 
-		// Set up progress bar
 		stat, err := file.Stat()
 		if err != nil {
 			log.Fatalln("Failed to stat file:", err)
 		}
-		progressReader := util.NewProgressReader(file, stat.Size())
+
+		// Store the file's metadata in the shards
+		metadata := &header.Metadata{
+			Name:        filepath.Base(fileName),
+			ContentType: mime.TypeByExtension(filepath.Ext(fileName)),
+			Mode:        uint32(stat.Mode().Perm()),
+			ModTime:     stat.ModTime(),
+		}
 
 		// Encode the file
 		log.Println("Encoding file...")
-		if _, err = encoder.Encode(progressReader, shardWriters, key, iv); err != nil {
+		if _, err = encoder.EncodeWithMetadata(context.Background(), file,
+			shardWriters, key, iv, metadata); err != nil {
 			log.Fatalln("Failed to encode file:", err)
 		}
-		fmt.Println("")
 
 		// Finalize shard headers
 		log.Println("Finalizing shard headers...")
@@ -131,12 +143,32 @@ func RunPipelineCmd() int {
 		if err != nil {
 			log.Fatalln("Failed to create reader:", err)
 		}
-		n, err := io.Copy(outputFile, util.NewProgressReader(reader, 0))
+		n, err := io.Copy(outputFile, reader)
 		if err != nil {
 			log.Fatalln("Failed to decode file:", err)
 		}
-		fmt.Println("")
 		log.Printf("Decoded %d bytes\n", n)
+
+		// Restore the file's metadata, skipping the fields that weren't stored
+		metadata, err := encoder.ReadMetadata(shards, key, iv)
+		if err != nil {
+			log.Fatalln("Failed to read metadata:", err)
+		}
+		if metadata != nil {
+			if metadata.Name != "" {
+				log.Printf("Original file name: %s\n", metadata.Name)
+			}
+			if metadata.Mode != 0 {
+				if err := outputFile.Chmod(os.FileMode(metadata.Mode)); err != nil {
+					log.Fatalln("Failed to restore file mode:", err)
+				}
+			}
+			if !metadata.ModTime.IsZero() {
+				if err := os.Chtimes(fileName, metadata.ModTime, metadata.ModTime); err != nil {
+					log.Fatalln("Failed to restore modification time:", err)
+				}
+			}
+		}
 	}
 
 	log.Println("Done.")
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/OhanaFS/stitch"
+	"github.com/OhanaFS/stitch/util"
+)
+
+// isTerminal returns whether the file is a terminal.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+// progressFunc returns a function that renders progress reports to stderr, or
+// nil if stderr isn't a terminal, so that the output isn't garbled when it is
+// redirected.
+func progressFunc() stitch.ProgressFunc {
+	if !isTerminal(os.Stderr) {
+		return nil
+	}
+	return func(p stitch.Progress) {
+		renderProgress(p.Stage.String(), p)
+	}
+}
+
+// renderProgress renders a progress report on a single line of stderr.
+func renderProgress(label string, p stitch.Progress) {
+	line := fmt.Sprintf("%s: %s", label, util.FormatSize(p.Bytes))
+	if p.Total > 0 {
+		line += fmt.Sprintf(" / %s (%d%%)", util.FormatSize(p.Total), p.Bytes*100/p.Total)
+	}
+	if p.Throughput > 0 {
+		line += fmt.Sprintf(", %s/s", util.FormatSize(int64(p.Throughput)))
+	}
+	if p.ETA > 0 {
+		line += fmt.Sprintf(", %s left", p.ETA.Round(time.Second))
+	}
+	fmt.Fprintf(os.Stderr, "\r%s\033[K", line)
+	if p.Done {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// newProgressReader wraps a reader so that the number of bytes read from it is
+// rendered to stderr, if stderr is a terminal.
+func newProgressReader(reader io.Reader, label string, total int64) io.Reader {
+	if !isTerminal(os.Stderr) {
+		return reader
+	}
+	start := time.Now()
+	p := stitch.Progress{Total: total}
+	return util.NewProgressReader(reader, func(n int) {
+		p.Bytes += int64(n)
+		p.Elapsed = time.Since(start)
+		p.Throughput = float64(p.Bytes) / p.Elapsed.Seconds()
+		if p.Total > p.Bytes && p.Throughput > 0 {
+			p.ETA = time.Duration(float64(p.Total-p.Bytes) / p.Throughput * float64(time.Second))
+		}
+		p.Done = n == 0 || (p.Total > 0 && p.Bytes >= p.Total)
+		renderProgress(label, p)
+	})
+}
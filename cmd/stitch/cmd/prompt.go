@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// setEcho turns the echo of the terminal on stdin on or off. It does nothing
+// where stty isn't available.
+func setEcho(on bool) {
+	arg := "-echo"
+	if on {
+		arg = "echo"
+	}
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	_ = cmd.Run()
+}
+
+// readSecret reads a line from stdin, so that secrets don't end up in the shell
+// history or the process list. If stdin is a terminal, the prompt is shown on
+// stderr and the input isn't echoed.
+func readSecret(scanner *bufio.Scanner, prompt string) (string, error) {
+	if isTerminal(os.Stdin) {
+		fmt.Fprint(os.Stderr, prompt)
+		setEcho(false)
+		defer func() {
+			setEcho(true)
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("no input")
+	}
+	return strings.TrimSpace(scanner.Text()), nil
+}
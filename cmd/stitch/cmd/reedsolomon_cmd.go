@@ -9,7 +9,6 @@ import (
 	"strconv"
 
 	"github.com/OhanaFS/stitch/reedsolomon"
-	"github.com/OhanaFS/stitch/util"
 )
 
 var (
@@ -72,7 +71,7 @@ func RunReedSolomonCmd() int {
 		if err != nil {
 			log.Fatalln("Failed to stat file:", err)
 		}
-		progressReader := util.NewProgressReader(file, stat.Size())
+		progressReader := newProgressReader(file, "split", stat.Size())
 
 		// Write file size to all of the shards
 		fsize := make([]byte, 8)
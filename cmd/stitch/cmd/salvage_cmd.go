@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/OhanaFS/stitch"
+)
+
+var (
+	SalvageCmd     = flag.NewFlagSet("salvage", flag.ExitOnError)
+	svInputFile    = SalvageCmd.String("input", "", "path to the file that was being encoded")
+	svOutputFile   = SalvageCmd.String("output", "", "path to write the recovered data to")
+	svDataShards   = SalvageCmd.Int("data-shards", 2, "number of data shards")
+	svParityShards = SalvageCmd.Int("parity-shards", 1, "number of parity shards")
+	svFileKey      = SalvageCmd.String("file-key", "00000000000000000000000000000000", "file key")
+	svFileKeySalt  = SalvageCmd.String("file-key-salt", "000000000000000000000000", "file key salt")
+)
+
+func RunSalvageCmd() int {
+	if *svInputFile == "" {
+		log.Fatalln("You must specify the file that was being encoded with -input.")
+	}
+
+	// Create the encoder
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   uint8(*svDataShards),
+		ParityShards: uint8(*svParityShards),
+		KeyThreshold: uint8(*svDataShards),
+		Progress:     progressFunc(),
+		Logger:       cliLogger{},
+	})
+
+	// Get key and IV
+	key, err := hex.DecodeString(*svFileKey)
+	if err != nil {
+		log.Fatalln("Invalid key:", err)
+	}
+	iv, err := hex.DecodeString(*svFileKeySalt)
+	if err != nil {
+		log.Fatalln("Invalid IV:", err)
+	}
+
+	// Open the shards for reading and writing, as they may be finalized
+	totalShards := *svDataShards + *svParityShards
+	var shards []io.ReadWriteSeeker
+	for i := 0; i < totalShards; i++ {
+		shardFile, err := os.OpenFile(*svInputFile+".shard"+strconv.Itoa(i), os.O_RDWR, 0)
+		if err != nil {
+			log.Println("Failed to open shard:", err)
+			continue
+		}
+		defer shardFile.Close()
+		shards = append(shards, shardFile)
+	}
+
+	// Open the output file, if any
+	var output io.Writer
+	if *svOutputFile != "" {
+		outputFile, err := os.Create(*svOutputFile)
+		if err != nil {
+			log.Fatalln("Failed to open output file:", err)
+		}
+		defer outputFile.Close()
+		output = outputFile
+	}
+
+	// Salvage the shards
+	log.Println("Salvaging shards...")
+	res, err := encoder.Salvage(shards, output, key, iv)
+	if err != nil {
+		log.Fatalln("Failed to salvage shards:", err)
+	}
+
+	if res.Finalized {
+		fmt.Println("The shards were finalized, and the whole file is readable.")
+	} else if output == nil {
+		fmt.Println("The shards could not be finalized. Use -output to recover the start of the file.")
+		return 1
+	} else {
+		fmt.Println("The shards could not be finalized, only the start of the file was recovered.")
+	}
+	if output != nil {
+		fmt.Printf("Recovered %d bytes to %s\n", res.RecoveredBytes, *svOutputFile)
+	}
+
+	return 0
+}
@@ -13,6 +13,11 @@ var subcommands = map[string]*flag.FlagSet{
 	cmd.ReedsolomonCmd.Name(): cmd.ReedsolomonCmd,
 	cmd.PipelineCmd.Name():    cmd.PipelineCmd,
 	cmd.BenchCmd.Name():       cmd.BenchCmd,
+	cmd.KeysplitCmd.Name():    cmd.KeysplitCmd,
+	cmd.KeycombineCmd.Name():  cmd.KeycombineCmd,
+	cmd.MigrateCmd.Name():     cmd.MigrateCmd,
+	cmd.SalvageCmd.Name():     cmd.SalvageCmd,
+	cmd.EstimateCmd.Name():    cmd.EstimateCmd,
 }
 
 func run() int {
@@ -41,6 +46,16 @@ func run() int {
 		return cmd.RunPipelineCmd()
 	case cmd.BenchCmd.Name():
 		return cmd.RunBenchCmd()
+	case cmd.KeysplitCmd.Name():
+		return cmd.RunKeysplitCmd()
+	case cmd.KeycombineCmd.Name():
+		return cmd.RunKeycombineCmd()
+	case cmd.MigrateCmd.Name():
+		return cmd.RunMigrateCmd()
+	case cmd.SalvageCmd.Name():
+		return cmd.RunSalvageCmd()
+	case cmd.EstimateCmd.Name():
+		return cmd.RunEstimateCmd()
 	}
 
 	return 0
@@ -1,11 +1,19 @@
 package stitch
 
 import (
+	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
 	"fmt"
 	"io"
-	"log"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	aesgcm "github.com/OhanaFS/stitch/aes"
 	"github.com/OhanaFS/stitch/header"
@@ -16,48 +24,142 @@ import (
 	"github.com/klauspost/compress/zstd"
 )
 
+// consensusKey returns a string made of the header fields that should be the
+// same across every shard of a file.
+func consensusKey(h *header.Header) string {
+	return fmt.Sprintf("%d:%d:%d:%d:%d:%d:%d:%x",
+		h.EncodedSize(), h.ShardCount, h.EncryptedSize, h.RSBlockSize, h.AESBlockSize,
+		h.FileSize, h.CompressedSize, h.Sealed)
+}
+
 // readHeader reads the header from the shards. It returns the index of any
-// complete header, a slice of the headers, and a slice of correctly-positioned
-// readers.
+// complete header, a slice of the headers, a slice of correctly-positioned
+// readers, the indices of any suspect shards, and the indices of any shards
+// that belong to a different file. See pickHeaders() for how the headers are
+// cross-checked.
 //
-// The slice of headers is not necessarily in the same order as the shards.
+// The slice of headers is in the same order as the shards, not necessarily in
+// the order of the shard indices.
 func readHeader(shards []io.ReadSeeker, totalShards int) (
-	okIdx int, headers []header.Header, shardReaders []io.ReadSeeker, err error,
+	okIdx int, headers []header.Header, shardReaders []io.ReadSeeker,
+	suspect []int, foreign []int, err error,
 ) {
-	// Allocate a buffer to read the header into.
-	headerBuf := make([]byte, header.HeaderSize)
-	// Create a slice to hold the headers.
-	headers = make([]header.Header, totalShards)
-	// Create a slice to hold the correctly-indexed shard readers.
+	// Try to read and parse the headers, falling back to the trailer and
+	// skipping corrupted ones.
+	headers = make([]header.Header, len(shards))
+	valid := make([]bool, len(shards))
+	for i, shard := range shards {
+		hdr, err := readShardHeader(shard)
+		if err != nil {
+			continue
+		}
+		headers[i] = *hdr
+		valid[i] = true
+	}
+
+	okIdx, suspect, foreign, err = pickHeaders(headers, valid, totalShards)
+
+	// Place the shards with valid headers according to the index in the header.
 	shardReaders = make([]io.ReadSeeker, totalShards)
+	for i := range headers {
+		if headers[i].IsComplete {
+			shardReaders[headers[i].ShardIndex] = shards[i]
+		}
+	}
+
+	return
+}
+
+// pickHeaders cross-checks the headers that were read from a set of shards.
+// valid specifies which of the headers were read successfully. It returns the
+// index of any complete header, the indices of any suspect shards, and the
+// indices of any shards that belong to a different file.
+//
+// The shards are first grouped by their file ID, and only the shards that
+// belong to the file that most of the shards belong to are used. If there is no
+// such file, ErrShardFromDifferentFile is returned. The fields that describe the
+// file are then cross-checked across all complete headers, and the values that
+// most of the headers agree on are used. Shards with headers that disagree are
+// considered suspect. The headers of suspect and foreign shards, and of shards
+// with an impossible shard index, are cleared.
+func pickHeaders(headers []header.Header, valid []bool, totalShards int) (
+	okIdx int, suspect []int, foreign []int, err error,
+) {
 	// okIdx is the index of any shard that has a valid header.
 	okIdx = -1
 
-	// Seek to the beginning of each shard.
-	for i, shard := range shards {
-		if _, e := shard.Seek(0, io.SeekStart); e != nil {
-			err = fmt.Errorf("failed to seek to beginning of shard %d: %v", i, e)
-			return
+	// Tally up the number of shards belonging to each file.
+	files := make(map[string]int)
+	for i := range headers {
+		if !valid[i] {
+			continue
 		}
+
+		// Discard headers with an impossible shard index.
+		if headers[i].ShardIndex < 0 || headers[i].ShardIndex >= totalShards {
+			headers[i] = header.Header{}
+			valid[i] = false
+			continue
+		}
+
+		files[string(headers[i].FileID)]++
 	}
 
-	for i, shard := range shards {
-		// Try to read the shard
-		if _, err := shard.Read(headerBuf); err != nil {
+	// Pick the file that most shards belong to.
+	fileID, fileVotes, tied := "", 0, false
+	for id, n := range files {
+		if n > fileVotes {
+			fileID, fileVotes, tied = id, n, false
+		} else if n == fileVotes {
+			tied = true
+		}
+	}
+	if tied {
+		err = ErrShardFromDifferentFile
+		return
+	}
+
+	// Leave out the shards of other files, and tally up the votes of each
+	// complete header.
+	votes := make(map[string]int)
+	for i := range headers {
+		if !valid[i] {
 			continue
 		}
+		if string(headers[i].FileID) != fileID {
+			foreign = append(foreign, i)
+			headers[i] = header.Header{}
+			continue
+		}
+		if headers[i].IsComplete {
+			votes[consensusKey(&headers[i])]++
+		}
+	}
+
+	// Pick the values that most headers agree on.
+	majority, majorityVotes := "", 0
+	for i := range headers {
+		if !headers[i].IsComplete {
+			continue
+		}
+		key := consensusKey(&headers[i])
+		if votes[key] > majorityVotes {
+			majority, majorityVotes = key, votes[key]
+		}
+	}
 
-		// Try to parse the header.
-		if err := headers[i].Decode(headerBuf); err != nil {
+	for i := range headers {
+		if !headers[i].IsComplete {
 			continue
 		}
 
-		// If the header is valid, set the okIdx and append the shard to the shard
-		// readers slice, according to the index in the header.
-		if headers[i].IsComplete && headers[i].ShardIndex < totalShards {
-			shardReaders[headers[i].ShardIndex] = shard
-			okIdx = i
+		// Leave out headers that disagree with the majority.
+		if consensusKey(&headers[i]) != majority {
+			suspect = append(suspect, i)
+			headers[i] = header.Header{}
+			continue
 		}
+		okIdx = i
 	}
 
 	// Return an error if no valid header was found.
@@ -68,98 +170,438 @@ func readHeader(shards []io.ReadSeeker, totalShards int) (
 	return
 }
 
+// maxKeyShareCombinations limits the number of share subsets that are tried
+// when the key shares cannot be combined all at once.
+const maxKeyShareCombinations = 4096
+
+// combinations calls fn with every subset of size k of the indices [0, n), in
+// lexicographic order, until fn returns false or limit subsets have been
+// visited.
+func combinations(n, k, limit int, fn func(idx []int) bool) {
+	if k > n || k <= 0 {
+		return
+	}
+	idx := make([]int, k)
+	for i := range idx {
+		idx[i] = i
+	}
+	for visited := 0; visited < limit; visited++ {
+		if !fn(idx) {
+			return
+		}
+
+		// Advance to the next subset.
+		i := k - 1
+		for i >= 0 && idx[i] == n-k+i {
+			i--
+		}
+		if i < 0 {
+			return
+		}
+		idx[i]++
+		for j := i + 1; j < k; j++ {
+			idx[j] = idx[j-1] + 1
+		}
+	}
+}
+
 // combineHeaderKeys combines the keys from the header and decrypts it with the
-// supplied key and iv.
-func combineHeaderKeys(headers []header.Header, key, iv []byte) ([]byte, error) {
-	// Gather the key pieces into a slice of byte slices.
-	var fileKeyPieces [][]byte
+// supplied key and iv. It also returns the shard indices of any key shares that
+// turned out to be corrupted.
+//
+// Key shares are grouped by their key generation, including the pending shares
+// of an unfinished key rotation, and only shares of the same generation are
+// combined. If the headers carry key check values and none of them match the
+// supplied key, ErrWrongKey is returned.
+func combineHeaderKeys(headers []header.Header, key, iv []byte, threshold int) (
+	fileKey []byte, badShards []int, err error,
+) {
+	// Gather the key pieces by generation.
+	pieces := make(map[uint32][][]byte)
+	pieceShards := make(map[uint32][]int)
+	var generations []uint32
+	hasKeyCheck := false
+	addPiece := func(gen uint32, piece, pieceKeyCheck, fileID []byte, shardIndex int) {
+		// Skip pieces that are wrapped with a different key.
+		if len(pieceKeyCheck) > 0 {
+			hasKeyCheck = true
+			if !hmac.Equal(pieceKeyCheck, keyCheckValue(key, iv, fileID)) {
+				return
+			}
+		}
+		if _, ok := pieces[gen]; !ok {
+			generations = append(generations, gen)
+		}
+		pieces[gen] = append(pieces[gen], piece)
+		pieceShards[gen] = append(pieceShards[gen], shardIndex)
+	}
 	for _, h := range headers {
 		if !h.IsComplete {
 			continue
 		}
-		fileKeyPieces = append(fileKeyPieces, h.FileKey)
+		addPiece(h.KeyGeneration, h.FileKey, h.KeyCheck, h.FileID, h.ShardIndex)
+		if len(h.PendingFileKey) > 0 {
+			addPiece(h.KeyGeneration+1, h.PendingFileKey, h.PendingKeyCheck, h.FileID,
+				h.ShardIndex)
+		}
+	}
+	if hasKeyCheck && len(generations) == 0 {
+		return nil, nil, ErrWrongKey
 	}
 
-	// Combine the key pieces into a single encrypted key.
-	ciphertext, err := shamir.Combine(fileKeyPieces)
-	if err != nil {
-		return nil, fmt.Errorf("failed to combine header keys: %v", err)
+	// Try the generation with the most pieces first.
+	sort.SliceStable(generations, func(i, j int) bool {
+		return len(pieces[generations[i]]) > len(pieces[generations[j]])
+	})
+	err = ErrNotEnoughKeyShards
+	for _, gen := range generations {
+		if len(pieces[gen]) < threshold {
+			continue
+		}
+		fileKey, badShards, err = combineKeyShares(pieces[gen], pieceShards[gen],
+			key, iv, threshold)
+		if err == nil {
+			return fileKey, badShards, nil
+		}
+	}
+
+	// Without a key check value, a wrong key looks the same as corrupted
+	// shares.
+	if !hasKeyCheck || err == ErrNotEnoughKeyShards {
+		return nil, nil, err
 	}
+	return nil, nil, ErrCorruptKeyShares
+}
 
-	// Decrypt the file key with the user-supplied key.
+// combineKeyShares combines a set of key shares of the same generation and
+// decrypts the result with the supplied key and iv. Subsets of threshold shares
+// are tried until one of them decrypts, and every other share is checked
+// against it. The shard indices of the shares that don't agree with it are
+// returned.
+func combineKeyShares(fileKeyPieces [][]byte, pieceShards []int, key, iv []byte,
+	threshold int) (fileKey []byte, badShards []int, err error) {
+	// Prepare the cipher to decrypt the file key with the user-supplied key.
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher for file key: %v", err)
+		return nil, nil, fmt.Errorf("failed to create cipher for file key: %v", err)
 	}
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create gcm cipher for file key: %v", err)
+		return nil, nil, fmt.Errorf("failed to create gcm cipher for file key: %v", err)
+	}
+	decrypt := func(pieces [][]byte) (ciphertext, fileKey []byte, err error) {
+		// Combine the key pieces into a single encrypted key.
+		ciphertext, err = shamir.Combine(pieces)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to combine header keys: %v", err)
+		}
+		fileKey, err = gcm.Open(nil, iv, ciphertext, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt file key: %v", err)
+		}
+		return ciphertext, fileKey, nil
+	}
+
+	// Without more pieces than needed, they can only be combined all at once.
+	if threshold < 2 || len(fileKeyPieces) <= threshold {
+		_, fileKey, err = decrypt(fileKeyPieces)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fileKey, nil, nil
+	}
+
+	// Find a subset of the pieces that decrypts. Combining all of the pieces at
+	// once isn't enough to tell that none of them are corrupted, as the errors
+	// of several corrupted pieces can cancel out.
+	var ciphertext []byte
+	var goodIdx []int
+	subset := make([][]byte, threshold)
+	combinations(len(fileKeyPieces), threshold, maxKeyShareCombinations,
+		func(idx []int) bool {
+			for i, j := range idx {
+				subset[i] = fileKeyPieces[j]
+			}
+			ciphertext, fileKey, err = decrypt(subset)
+			goodIdx = idx
+			return err != nil
+		})
+	if err != nil {
+		return nil, nil, err
 	}
-	fileKey, err := gcm.Open(nil, iv, ciphertext, nil)
+
+	// Check the remaining pieces against the good subset. A piece is good if it
+	// can stand in for one of the good pieces and still produce the same
+	// ciphertext.
+	inSubset := make(map[int]bool, threshold)
+	for _, j := range goodIdx {
+		inSubset[j] = true
+	}
+	for j, piece := range fileKeyPieces {
+		if inSubset[j] {
+			continue
+		}
+		subset[0] = piece
+		c, e := shamir.Combine(subset)
+		if e != nil || !bytes.Equal(c, ciphertext) {
+			badShards = append(badShards, pieceShards[j])
+		}
+	}
+
+	return fileKey, badShards, nil
+}
+
+// unlockHeaders reconstructs the file key from the headers and authenticates
+// the complete headers with it. It returns the first authenticated header and
+// the file key. The headers that fail authentication are cleared.
+func (e *Encoder) unlockHeaders(headers []header.Header, key, iv []byte) (
+	hdr header.Header, fileKey []byte, err error,
+) {
+	// Reconstruct and decrypt the encrypted file key from the headers.
+	fileKey, badShards, err := combineHeaderKeys(headers, key, iv, int(e.opts.KeyThreshold))
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt file key: %v", err)
+		err = fmt.Errorf("failed to combine file key pieces: %w", err)
+		return
+	}
+	for _, i := range badShards {
+		e.logger().Warn("corrupt key share", "shard", i)
 	}
 
-	return fileKey, nil
+	// Authenticate the headers with the file key. Headers without a MAC are only
+	// accepted if none of the headers of the same file have one, so that the MAC
+	// can't be stripped from a tampered header.
+	macRequired := make(map[string]bool)
+	for _, h := range headers {
+		if h.IsComplete && len(h.MAC) > 0 {
+			macRequired[string(h.FileID)] = true
+		}
+	}
+	authenticated := false
+	for i, h := range headers {
+		if !h.IsComplete {
+			continue
+		}
+		if err := h.VerifyMAC(fileKey, macRequired[string(h.FileID)]); err != nil {
+			e.logger().Warn("shard header failed authentication",
+				"shard", h.ShardIndex, "error", err)
+			headers[i] = header.Header{}
+			continue
+		}
+		if !authenticated {
+			hdr = h
+			authenticated = true
+		}
+	}
+	if !authenticated {
+		err = ErrNoCompleteHeader
+	}
+
+	return
 }
 
-// NewReadSeeker returns a new ReadSeeker that can be used to access the data
-// contained within the shards.
-func (e *Encoder) NewReadSeeker(shards []io.ReadSeeker, key []byte, iv []byte) (
-	io.ReadSeeker, error,
+// newRSDecoder creates a Reed-Solomon encoder for reading shards, which logs and
+// counts the corrupted blocks that it corrects. A ReadSeeker reads the same
+// blocks again after seeking back, so each block is only reported once.
+func (e *Encoder) newRSDecoder(blockSize int) (*reedsolomon.Encoder, error) {
+	encRS, err := reedsolomon.NewEncoder(
+		int(e.opts.DataShards), int(e.opts.ParityShards), blockSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	logger, metrics := e.logger(), e.metrics()
+	var mu sync.Mutex
+	reported := make(map[[2]int]bool)
+	encRS.OnCorruptBlock = func(shard, block int) {
+		mu.Lock()
+		seen := reported[[2]int{shard, block}]
+		reported[[2]int{shard, block}] = true
+		mu.Unlock()
+		if seen {
+			return
+		}
+		logger.Warn("corrected corrupt block", "shard", shard, "block", block)
+		metrics.AddCounter(MetricCorruptBlocks, StageDecode, 1)
+	}
+	return encRS, nil
+}
+
+// openEncryptedStream reads the headers from the supplied shards, reconstructs
+// the file key, and returns a reader for the encrypted data contained within
+// the shards, along with the header, its private fields and the file key.
+func (e *Encoder) openEncryptedStream(shards []io.ReadSeeker, key []byte, iv []byte) (
+	hdr header.Header, priv *header.Private, fileKey []byte, rRS io.ReadSeeker, err error,
 ) {
 	totalShards := int(e.opts.DataShards + e.opts.ParityShards)
 
 	// Check if there are sufficient input shards
 	if len(shards) < int(e.opts.DataShards) {
-		return nil, ErrNotEnoughShards
+		err = ErrNotEnoughShards
+		return
 	}
 
 	// Try to read the shard headers.
-	okIdx, headers, shardReaders, err := readHeader(shards, totalShards)
+	_, headers, shardReaders, suspect, foreign, err := readHeader(shards, totalShards)
+	if err != nil {
+		err = fmt.Errorf("failed to read header: %w", err)
+		return
+	}
+	for _, i := range foreign {
+		e.logger().Warn("shard belongs to a different file", "shard", i)
+	}
+	for _, i := range suspect {
+		e.logger().Warn("shard header disagrees with the other shards", "shard", i)
+	}
+
+	// Reconstruct the file key and authenticate the headers with it. The shards
+	// are placed again afterwards, so that a shard with a forged header can't
+	// take the place of another one.
+	hdr, fileKey, err = e.unlockHeaders(headers, key, iv)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read header: %v", err)
+		return
+	}
+	shardReaders = make([]io.ReadSeeker, totalShards)
+	for i := range headers {
+		if headers[i].IsComplete {
+			shardReaders[headers[i].ShardIndex] = shards[i]
+		}
 	}
-	hdr := headers[okIdx]
 
-	// Pad nil readers
+	// Check if there are sufficient shards left to reconstruct the file.
+	available := 0
+	for _, reader := range shardReaders {
+		if reader != nil {
+			available++
+		}
+	}
+	if available < int(e.opts.DataShards) {
+		err = ErrNotEnoughShards
+		if len(foreign) > 0 {
+			err = ErrShardFromDifferentFile
+		}
+		return
+	}
+
+	// Missing shards are left as nil, and are reconstructed by the Reed-Solomon
+	// decoder.
 	for i, reader := range shardReaders {
 		if reader == nil {
-			log.Printf("[WARN] Missing shard %d", i)
-			shardReaders[i] = &util.ZeroReadSeeker{Size: int64(hdr.EncryptedSize)}
+			e.logger().Warn("missing shard", "shard", i)
 		}
 	}
 
-	// Reconstruct and decrypt the encrypted file key from the headers.
-	fileKey, err := combineHeaderKeys(headers, key, iv)
+	// Decrypt the private header fields.
+	priv, err = hdr.OpenPrivate(fileKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to combine file key pieces: %v", err)
+		err = fmt.Errorf("failed to open sealed header: %w", err)
+		return
 	}
 
 	// Seek shards to beginning of data.
 	for i, reader := range shardReaders {
-		if _, err := reader.Seek(header.HeaderSize, io.SeekStart); err != nil {
-			return nil, fmt.Errorf("failed to seek to beginning of data in shard %d: %v", i, err)
+		if reader == nil {
+			continue
+		}
+		if _, e := reader.Seek(int64(hdr.EncodedSize()), io.SeekStart); e != nil {
+			err = fmt.Errorf("failed to seek to beginning of data in shard %d: %v", i, e)
+			return
 		}
 	}
 
 	// Prepare offset reader for shards
 	shardData := make([]io.ReadSeeker, totalShards)
 	for i, reader := range shardReaders {
-		shardData[i] = util.NewOffsetReader(reader, header.HeaderSize)
+		if reader != nil {
+			shardData[i] = util.NewOffsetReader(reader, int64(hdr.EncodedSize()))
+		}
 	}
 
 	// Prepare the Reed-Solomon decoder.
-	encRS, err := reedsolomon.NewEncoder(
-		int(e.opts.DataShards), int(e.opts.ParityShards), hdr.RSBlockSize,
-	)
+	encRS, err := e.newRSDecoder(hdr.RSBlockSize)
+	if err != nil {
+		err = fmt.Errorf("failed to create Reed-Solomon encoder: %v", err)
+		return
+	}
+	rRS = reedsolomon.NewReadSeeker(encRS, shardData, int64(hdr.EncryptedSize))
+
+	return
+}
+
+// readPrivate reads the headers from the shards, reconstructs the file key, and
+// returns the private fields of an authenticated header. Unlike
+// openEncryptedStream(), it only needs enough shards to reconstruct the file
+// key, not the data.
+func (e *Encoder) readPrivate(shards []io.ReadSeeker, key []byte, iv []byte) (
+	*header.Private, error,
+) {
+	totalShards := int(e.opts.DataShards + e.opts.ParityShards)
+
+	_, headers, _, _, _, err := readHeader(shards, totalShards)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create Reed-Solomon encoder: %v", err)
+		return nil, fmt.Errorf("failed to read header: %w", err)
 	}
-	rRS := reedsolomon.NewReadSeeker(encRS, shardData, int64(hdr.EncryptedSize))
+	hdr, fileKey, err := e.unlockHeaders(headers, key, iv)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := hdr.OpenPrivate(fileKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sealed header: %w", err)
+	}
+	return priv, nil
+}
+
+// ReadMetadata returns the metadata that was supplied when the file was
+// encoded, or nil if there isn't any.
+func (e *Encoder) ReadMetadata(shards []io.ReadSeeker, key []byte, iv []byte) (
+	*header.Metadata, error,
+) {
+	priv, err := e.readPrivate(shards, key, iv)
+	if err != nil {
+		return nil, err
+	}
+	return priv.Metadata, nil
+}
+
+// ReadDigests returns the additional digests of the file that were stored in
+// the header when it was encoded, or nil if there aren't any.
+func (e *Encoder) ReadDigests(shards []io.ReadSeeker, key []byte, iv []byte) (
+	map[DigestAlgorithm][]byte, error,
+) {
+	priv, err := e.readPrivate(shards, key, iv)
+	if err != nil {
+		return nil, err
+	}
+	return loadedSums(priv.Digests), nil
+}
+
+// NewReadSeeker returns a new ReadSeeker that can be used to access the data
+// contained within the shards.
+func (e *Encoder) NewReadSeeker(shards []io.ReadSeeker, key []byte, iv []byte) (
+	io.ReadSeeker, error,
+) {
+	return e.NewReadSeekerContext(context.Background(), shards, key, iv)
+}
+
+// NewReadSeekerContext is like NewReadSeeker, but the returned ReadSeeker stops
+// reading and seeking once the context is done, returning the context's error.
+func (e *Encoder) NewReadSeekerContext(ctx context.Context, shards []io.ReadSeeker,
+	key []byte, iv []byte) (io.ReadSeeker, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Open the encrypted data contained within the shards.
+	start := time.Now()
+	hdr, priv, fileKey, rRS, err := e.openEncryptedStream(shards, key, iv)
+	if err != nil {
+		return nil, err
+	}
+	bytesIn := new(int64)
+	rRS = countingReadSeeker{ReadSeeker: rRS, n: bytesIn}
 
 	// Prepare the AES cipher to decrypt the data.
-	rAES, err := aesgcm.NewReader(rRS, fileKey, hdr.AESBlockSize, hdr.CompressedSize)
+	rAES, err := aesgcm.NewReader(rRS, fileKey, hdr.AESBlockSize, priv.CompressedSize)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create AES reader: %v", err)
 	}
@@ -175,8 +617,363 @@ func (e *Encoder) NewReadSeeker(shards []io.ReadSeeker, key []byte, iv []byte) (
 	}
 
 	// Limit the reader to the size of the plaintext.
-	rLim := util.NewLimitReader(rZstd, int64(hdr.FileSize))
+	rLim := util.NewLimitReader(rZstd, int64(priv.FileSize))
+
+	// Report the progress of reading the data, and record the measurements of
+	// the stage once the end of the data is reached.
+	reader := &progressReadSeeker{
+		reader:   rLim,
+		progress: e.newProgress(StageDecode, int64(priv.FileSize)),
+		onEOF: func() {
+			e.recordStage(StageDecode, start, atomic.LoadInt64(bytesIn),
+				int64(priv.FileSize))
+		},
+	}
 
 	// Return the reader.
-	return rLim, nil
+	return util.NewContextReadSeeker(ctx, reader), nil
+}
+
+// Decode reads the shards sequentially and writes the decoded file to dst.
+// Unlike NewReadSeeker(), the shards don't need to support seeking, so they can
+// be streamed directly from the network or from an archive. Each shard is read
+// from start to end exactly once.
+//
+// The decoded data is checked against the file hash, and any additional digests
+// stored in the header, once it has been written to dst, and ErrHashMismatch is
+// returned if it doesn't match.
+//
+// Shards written in streaming mode are decoded using the key splits and layout
+// in their leading header, and their complete header is taken from the trailer
+// once the data has been decoded. The trailers are authenticated and checked
+// against the decoded data before the file hash is compared. Since the stored
+// digests aren't known until then, only the additional digests listed in the
+// Digests option are checked.
+func (e *Encoder) Decode(dst io.Writer, shards []io.Reader, key []byte, iv []byte) error {
+	return e.DecodeContext(context.Background(), dst, shards, key, iv)
+}
+
+// DecodeContext is like Decode, but stops once the context is done, returning
+// the context's error.
+func (e *Encoder) DecodeContext(ctx context.Context, dst io.Writer, shards []io.Reader,
+	key []byte, iv []byte) error {
+	totalShards := int(e.opts.DataShards + e.opts.ParityShards)
+
+	// Check if there are sufficient input shards
+	if len(shards) < int(e.opts.DataShards) {
+		return ErrNotEnoughShards
+	}
+
+	start := time.Now()
+
+	// Read the shard headers, which leaves the shards at the start of their
+	// data.
+	headers := make([]header.Header, len(shards))
+	valid := make([]bool, len(shards))
+	for i, shard := range shards {
+		hdr, err := header.Read(shard)
+		if err != nil {
+			continue
+		}
+		headers[i] = *hdr
+		valid[i] = true
+	}
+
+	// Shards written in streaming mode only have a complete header in their
+	// trailer.
+	for i := range headers {
+		if valid[i] && !headers[i].IsComplete && headers[i].Footer {
+			return e.decodeStreaming(ctx, dst, shards, headers, valid, key, iv, start)
+		}
+	}
+
+	_, suspect, foreign, err := pickHeaders(headers, valid, totalShards)
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	for _, i := range foreign {
+		e.logger().Warn("shard belongs to a different file", "shard", i)
+	}
+	for _, i := range suspect {
+		e.logger().Warn("shard header disagrees with the other shards", "shard", i)
+	}
+
+	// Reconstruct the file key and authenticate the headers with it.
+	hdr, fileKey, err := e.unlockHeaders(headers, key, iv)
+	if err != nil {
+		return err
+	}
+
+	// Place the shards according to the index in their header. Missing shards
+	// are left as nil, and are reconstructed by the Reed-Solomon decoder. Only
+	// the first of several shards with the same index is used.
+	shardReaders := make([]io.Reader, totalShards)
+	available := 0
+	for i, h := range headers {
+		if !h.IsComplete || shardReaders[h.ShardIndex] != nil {
+			continue
+		}
+		shardReaders[h.ShardIndex] = shards[i]
+		available++
+	}
+	if available < int(e.opts.DataShards) {
+		if len(foreign) > 0 {
+			return ErrShardFromDifferentFile
+		}
+		return ErrNotEnoughShards
+	}
+	for i, reader := range shardReaders {
+		if reader == nil {
+			e.logger().Warn("missing shard", "shard", i)
+		}
+	}
+
+	// Decrypt the private header fields.
+	priv, err := hdr.OpenPrivate(fileKey)
+	if err != nil {
+		return fmt.Errorf("failed to open sealed header: %w", err)
+	}
+
+	// Reconstruct the encrypted data.
+	encRS, err := e.newRSDecoder(hdr.RSBlockSize)
+	if err != nil {
+		return fmt.Errorf("failed to create Reed-Solomon encoder: %v", err)
+	}
+	rRS := encRS.NewReaderContext(ctx, shardReaders, int64(hdr.EncryptedSize))
+	defer rRS.Close()
+	bytesIn := new(int64)
+
+	// Decrypt the data, leaving out the padding after the compressed data.
+	rAES, err := aesgcm.NewStreamReader(countingReader{Reader: rRS, n: bytesIn}, fileKey, hdr.AESBlockSize, priv.CompressedSize)
+	if err != nil {
+		return fmt.Errorf("failed to create AES reader: %v", err)
+	}
+
+	// Decompress the frames one after the other, skipping the seek table.
+	decZstd, err := zstd.NewReader(rAES, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return fmt.Errorf("failed to create zstd reader: %v", err)
+	}
+	defer decZstd.Close()
+
+	// Write the data to the destination while hashing it, along with any
+	// additional digests stored in the header.
+	hash := sha256.New()
+	extraDigests := storedDigestSet(priv.Digests)
+	progress := e.newProgress(StageDecode, int64(priv.FileSize))
+	rProgress := util.NewProgressReader(decZstd, func(n int) {
+		progress.add(int64(n))
+	})
+	n, err := io.Copy(io.MultiWriter(dst, hash, extraDigests),
+		util.NewContextReader(ctx, rProgress))
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decode data: %w", err)
+	}
+	if uint64(n) != priv.FileSize || !hmac.Equal(hash.Sum(nil), priv.FileHash) {
+		return ErrHashMismatch
+	}
+	for alg, sum := range extraDigests.sums() {
+		if !hmac.Equal(sum, priv.Digests[string(alg)]) {
+			return ErrHashMismatch
+		}
+	}
+	progress.finish()
+	e.recordStage(StageDecode, start, atomic.LoadInt64(bytesIn), n)
+
+	return nil
+}
+
+// leadingHeader returns the header with only the fields that are known when the
+// leading header of a shard is written in streaming mode. It is marked as
+// complete, so that it can be cross-checked and unlocked like a complete
+// header.
+func leadingHeader(h header.Header) header.Header {
+	h.EncryptedSize = 0
+	h.FileSize = 0
+	h.CompressedSize = 0
+	h.Sealed = nil
+	h.MAC = nil
+	h.PendingMAC = nil
+	h.IsComplete = true
+	return h
+}
+
+// decodeStreaming is like DecodeContext, for shards written in streaming mode,
+// whose leading headers have been read into headers. The leading headers have
+// the key splits and the layout of the data, which is enough to decode it, but
+// the sizes and hashes are only known once the trailers are reached.
+func (e *Encoder) decodeStreaming(ctx context.Context, dst io.Writer, shards []io.Reader,
+	headers []header.Header, valid []bool, key, iv []byte, start time.Time) error {
+	totalShards := int(e.opts.DataShards + e.opts.ParityShards)
+
+	// Shards that were finalized have a complete header at their start, which
+	// is compared on the same fields as the leading headers.
+	for i := range headers {
+		if valid[i] {
+			headers[i] = leadingHeader(headers[i])
+		}
+	}
+	okIdx, suspect, foreign, err := pickHeaders(headers, valid, totalShards)
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	for _, i := range foreign {
+		e.logger().Warn("shard belongs to a different file", "shard", i)
+	}
+	for _, i := range suspect {
+		e.logger().Warn("shard header disagrees with the other shards", "shard", i)
+	}
+	layout := headers[okIdx]
+
+	// Reconstruct the file key from the leading headers. It is checked against
+	// the trailers once they are reached.
+	fileKey, badShards, err := combineHeaderKeys(headers, key, iv, int(e.opts.KeyThreshold))
+	if err != nil {
+		return fmt.Errorf("failed to combine file key pieces: %w", err)
+	}
+	for _, i := range badShards {
+		e.logger().Warn("corrupt key share", "shard", i)
+	}
+
+	// Place the shards according to the index in their header, holding back
+	// their trailers.
+	tails := make([]*trailerReader, len(shards))
+	shardReaders := make([]io.Reader, totalShards)
+	available := 0
+	for i := range headers {
+		h := &headers[i]
+		if !h.IsComplete || shardReaders[h.ShardIndex] != nil {
+			continue
+		}
+		tails[i] = newTrailerReader(shards[i], h)
+		shardReaders[h.ShardIndex] = tails[i]
+		available++
+	}
+	if available < int(e.opts.DataShards) {
+		if len(foreign) > 0 {
+			return ErrShardFromDifferentFile
+		}
+		return ErrNotEnoughShards
+	}
+	for i, reader := range shardReaders {
+		if reader == nil {
+			e.logger().Warn("missing shard", "shard", i)
+		}
+	}
+
+	// Reconstruct the encrypted data until the shards end.
+	encRS, err := e.newRSDecoder(layout.RSBlockSize)
+	if err != nil {
+		return fmt.Errorf("failed to create Reed-Solomon encoder: %v", err)
+	}
+	rRS := encRS.NewReaderContext(ctx, shardReaders, -1)
+	defer rRS.Close()
+	bytesIn := new(int64)
+	rEnc := countingReader{Reader: rRS, n: bytesIn}
+
+	// Decrypt the data, and stop after the seek table, as the size of the
+	// compressed data isn't known yet.
+	rAES, err := aesgcm.NewStreamReader(rEnc, fileKey, layout.AESBlockSize, math.MaxUint64)
+	if err != nil {
+		return fmt.Errorf("failed to create AES reader: %v", err)
+	}
+	rFrames := newFrameReader(rAES)
+	decZstd, err := zstd.NewReader(rFrames, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return fmt.Errorf("failed to create zstd reader: %v", err)
+	}
+	defer decZstd.Close()
+
+	// Write the data to the destination while hashing it.
+	hash := sha256.New()
+	extraDigests, err := newDigestSet(e.opts.Digests)
+	if err != nil {
+		return err
+	}
+	progress := e.newProgress(StageDecode, 0)
+	rProgress := util.NewProgressReader(decZstd, func(n int) {
+		progress.add(int64(n))
+	})
+	n, err := io.Copy(io.MultiWriter(dst, hash, extraDigests),
+		util.NewContextReader(ctx, rProgress))
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decode data: %w", err)
+	}
+
+	// Read the padding to reach the trailers.
+	if _, err := io.Copy(io.Discard, rEnc); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return fmt.Errorf("failed to decode data: %w", err)
+	}
+
+	// Authenticate the trailers, and make sure that they describe the shards
+	// that were decoded.
+	trailers := make([]header.Header, len(shards))
+	trailerValid := make([]bool, len(shards))
+	for i, tail := range tails {
+		if tail == nil {
+			continue
+		}
+		hdr, err := tail.trailer()
+		if err != nil {
+			e.logger().Warn("failed to read shard trailer",
+				"shard", headers[i].ShardIndex, "error", err)
+			continue
+		}
+		trailers[i] = *hdr
+		trailerValid[i] = true
+	}
+	_, suspect, _, err = pickHeaders(trailers, trailerValid, totalShards)
+	if err != nil {
+		return fmt.Errorf("failed to read trailer: %w", err)
+	}
+	for _, i := range suspect {
+		e.logger().Warn("shard trailer disagrees with the other shards", "shard", i)
+	}
+	hdr, trailerKey, err := e.unlockHeaders(trailers, key, iv)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(trailerKey, fileKey) {
+		return fmt.Errorf("%w: file key differs from the trailer", header.ErrCorruptHeader)
+	}
+	for i, h := range trailers {
+		if h.IsComplete && (h.ShardIndex != headers[i].ShardIndex ||
+			!bytes.Equal(h.FileID, headers[i].FileID)) {
+			return fmt.Errorf("%w: shard %d differs from its trailer",
+				header.ErrCorruptHeader, headers[i].ShardIndex)
+		}
+	}
+
+	// Check the decoded data against the trailer.
+	priv, err := hdr.OpenPrivate(fileKey)
+	if err != nil {
+		return fmt.Errorf("failed to open sealed header: %w", err)
+	}
+	encrypted := uint64(atomic.LoadInt64(bytesIn))
+	stripeSize := uint64(hdr.RSBlockSize) * uint64(e.opts.DataShards)
+	stripes := (hdr.EncryptedSize + stripeSize - 1) / stripeSize
+	if rFrames.n != priv.CompressedSize || encrypted != stripes*stripeSize {
+		return ErrHashMismatch
+	}
+	if uint64(n) != priv.FileSize || !hmac.Equal(hash.Sum(nil), priv.FileHash) {
+		return ErrHashMismatch
+	}
+	for alg, sum := range extraDigests.sums() {
+		if stored, ok := priv.Digests[string(alg)]; ok && !hmac.Equal(sum, stored) {
+			return ErrHashMismatch
+		}
+	}
+	progress.finish()
+	e.recordStage(StageDecode, start, int64(encrypted), n)
+
+	return nil
 }
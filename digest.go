@@ -0,0 +1,121 @@
+package stitch
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"hash/crc32"
+
+	"lukechampine.com/blake3"
+)
+
+// DigestAlgorithm identifies a digest of the file plaintext that can be
+// computed while encoding, in addition to the SHA-256 file hash.
+type DigestAlgorithm string
+
+const (
+	// DigestMD5 is the MD5 digest, as used by S3 for the ETag of objects
+	// uploaded in a single part.
+	DigestMD5 DigestAlgorithm = "md5"
+	// DigestSHA1 is the SHA-1 digest, as used by git for its object IDs.
+	DigestSHA1 DigestAlgorithm = "sha1"
+	// DigestCRC32C is the CRC-32C checksum, stored in big-endian order.
+	DigestCRC32C DigestAlgorithm = "crc32c"
+	// DigestBLAKE3 is the 256-bit BLAKE3 digest.
+	DigestBLAKE3 DigestAlgorithm = "blake3"
+)
+
+// newDigest returns a new hash for the algorithm.
+func newDigest(alg DigestAlgorithm) (hash.Hash, error) {
+	switch alg {
+	case DigestMD5:
+		return md5.New(), nil
+	case DigestSHA1:
+		return sha1.New(), nil
+	case DigestCRC32C:
+		return crc32.New(castagnoli), nil
+	case DigestBLAKE3:
+		return blake3.New(32, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown digest algorithm: %q", alg)
+	}
+}
+
+// digestSet computes several digests of the same data at once.
+type digestSet map[DigestAlgorithm]hash.Hash
+
+// newDigestSet returns a digestSet for the algorithms, or nil if there are
+// none.
+func newDigestSet(algs []DigestAlgorithm) (digestSet, error) {
+	if len(algs) == 0 {
+		return nil, nil
+	}
+	set := make(digestSet, len(algs))
+	for _, alg := range algs {
+		h, err := newDigest(alg)
+		if err != nil {
+			return nil, err
+		}
+		set[alg] = h
+	}
+	return set, nil
+}
+
+func (s digestSet) Write(p []byte) (int, error) {
+	for _, h := range s {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// sums returns the digests of the data written so far, or nil if the set is
+// empty.
+func (s digestSet) sums() map[DigestAlgorithm][]byte {
+	if len(s) == 0 {
+		return nil
+	}
+	sums := make(map[DigestAlgorithm][]byte, len(s))
+	for alg, h := range s {
+		sums[alg] = h.Sum(nil)
+	}
+	return sums
+}
+
+// storedSums converts the digests to the form stored in the header.
+func storedSums(sums map[DigestAlgorithm][]byte) map[string][]byte {
+	if len(sums) == 0 {
+		return nil
+	}
+	stored := make(map[string][]byte, len(sums))
+	for alg, sum := range sums {
+		stored[string(alg)] = sum
+	}
+	return stored
+}
+
+// loadedSums converts the digests stored in the header back to their usual
+// form.
+func loadedSums(stored map[string][]byte) map[DigestAlgorithm][]byte {
+	if len(stored) == 0 {
+		return nil
+	}
+	sums := make(map[DigestAlgorithm][]byte, len(stored))
+	for alg, sum := range stored {
+		sums[DigestAlgorithm(alg)] = sum
+	}
+	return sums
+}
+
+// storedDigestSet returns a digestSet for the digests stored in the header,
+// leaving out algorithms that aren't known, so that the decoded data can be
+// checked against them.
+func storedDigestSet(stored map[string][]byte) digestSet {
+	set := make(digestSet, len(stored))
+	for alg := range stored {
+		if h, err := newDigest(DigestAlgorithm(alg)); err == nil {
+			set[DigestAlgorithm(alg)] = h
+		}
+	}
+	return set
+}
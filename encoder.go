@@ -1,13 +1,16 @@
 package stitch
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"fmt"
 	"io"
-	"os"
+	"math"
+	"time"
 
 	aesgcm "github.com/OhanaFS/stitch/aes"
 	"github.com/OhanaFS/stitch/header"
@@ -42,14 +45,109 @@ func splitFileKey(fileKey, key, iv []byte, shards, threshold int) ([][]byte, err
 	return fileKeySplit, nil
 }
 
+// keyCheckValue returns a fingerprint of the given key and iv for the file with
+// the given ID. It is stored in the header so that a wrong key can be detected
+// without relying on the integrity of the key shards. The file ID is mixed in so
+// that files wrapped with the same key and iv don't share a key check value.
+func keyCheckValue(key, iv, fileID []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("stitch key check"))
+	mac.Write(iv)
+	mac.Write(fileID)
+	return mac.Sum(nil)[:16]
+}
+
+// writeHeaders encodes each header and writes it to the corresponding shard.
+func writeHeaders(shards []io.Writer, headers []header.Header) error {
+	for i := range headers {
+		b, err := headers[i].Encode()
+		if err != nil {
+			return fmt.Errorf("failed to encode header: %v", err)
+		}
+		if _, err := shards[i].Write(b); err != nil {
+			return fmt.Errorf("failed to write header: %v", err)
+		}
+	}
+	return nil
+}
+
+// truncater is implemented by shards that can be truncated, such as *os.File.
+type truncater interface {
+	Truncate(size int64) error
+}
+
+// writeCompleteHeaders writes the complete headers to the shards. Shards that
+// implement io.WriterAt have their leading header patched in place, so that
+// they don't have to be finalized. Other shards have the header written to
+// their end, to be copied to the start by FinalizeHeader(). Shards that keep a
+// trailer always get a copy at the end, followed by a locator. It returns which
+// of the shards were patched in place.
+func writeCompleteHeaders(shards []io.Writer, headers []header.Header) (
+	patched []bool, err error,
+) {
+	patched = make([]bool, len(headers))
+	for i := range headers {
+		b, err := headers[i].Encode()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode header: %v", err)
+		}
+
+		// Try to patch the leading header, falling back to writing it to the end
+		// if it isn't possible, e.g. for files opened for appending.
+		if w, ok := shards[i].(io.WriterAt); ok {
+			if _, err := w.WriteAt(b, 0); err == nil {
+				patched[i] = true
+			}
+		}
+		if patched[i] && !headers[i].Trailer {
+			continue
+		}
+
+		if _, err := shards[i].Write(b); err != nil {
+			return nil, fmt.Errorf("failed to write header: %v", err)
+		}
+		if headers[i].Trailer {
+			if _, err := shards[i].Write(trailerLocator(&headers[i])); err != nil {
+				return nil, fmt.Errorf("failed to write trailer locator: %v", err)
+			}
+		}
+	}
+	return patched, nil
+}
+
 // Encode takes in a reader, performs the transformations and then splits the
 // data into multiple shards, writing them to the output writers. The output
 // writers are not closed after the data is written.
 //
-// After the data has finished encoding, a header will be written to the end of
-// each shard. At this point, the shards are not usable yet until the header is
-// finalized using the FinalizeHeader() function.
+// After the data has finished encoding, the header at the start of each shard
+// is rewritten if the shard implements io.WriterAt, such as *os.File. Otherwise,
+// a header will be written to the end of each shard. At this point, the shards
+// are not usable yet until the header is finalized using the FinalizeHeader()
+// function, unless the Streaming option is set.
 func (e *Encoder) Encode(data io.Reader, shards []io.Writer, key []byte, iv []byte) (*EncodingResult, error) {
+	return e.EncodeContext(context.Background(), data, shards, key, iv)
+}
+
+// EncodeContext is like Encode, but stops once the context is done, returning
+// the context's error. The shards are left incomplete in that case.
+func (e *Encoder) EncodeContext(ctx context.Context, data io.Reader, shards []io.Writer,
+	key []byte, iv []byte) (*EncodingResult, error) {
+	return e.encode(ctx, data, shards, key, iv, e.opts.Metadata)
+}
+
+// EncodeWithMetadata is like EncodeContext, but stores the supplied metadata
+// instead of the Metadata option, so that an Encoder can be shared between
+// files with different metadata.
+func (e *Encoder) EncodeWithMetadata(ctx context.Context, data io.Reader, shards []io.Writer,
+	key []byte, iv []byte, metadata *header.Metadata) (*EncodingResult, error) {
+	return e.encode(ctx, data, shards, key, iv, metadata)
+}
+
+// encode encodes the data into the shards, storing the metadata in the sealed
+// header.
+func (e *Encoder) encode(ctx context.Context, data io.Reader, shards []io.Writer,
+	key []byte, iv []byte, metadata *header.Metadata) (*EncodingResult, error) {
+	start := time.Now()
 	totalShards := int(e.opts.DataShards + e.opts.ParityShards)
 
 	// Check if the number of output writers matches the number of shards in the
@@ -57,6 +155,16 @@ func (e *Encoder) Encode(data io.Reader, shards []io.Writer, key []byte, iv []by
 	if len(shards) != totalShards {
 		return nil, ErrShardCountMismatch
 	}
+	if e.opts.Padding == PaddingMultiple && e.opts.PaddingMultiple == 0 {
+		return nil, ErrInvalidPadding
+	}
+
+	// Prepare the additional digests of the input.
+	extraDigests, err := newDigestSet(e.opts.Digests)
+	if err != nil {
+		return nil, err
+	}
+	storeDigests := e.opts.StoreDigests && extraDigests != nil
 
 	// Prepare a 256-bit AES key to encrypt the data.
 	fileKey := make([]byte, 32)
@@ -70,32 +178,79 @@ func (e *Encoder) Encode(data io.Reader, shards []io.Writer, key []byte, iv []by
 		return nil, fmt.Errorf("failed to split file key: %v", err)
 	}
 
+	// Generate a random ID to tie the shards together.
+	fileID := make([]byte, fileIDSize)
+	if _, err := rand.Read(fileID); err != nil {
+		return nil, fmt.Errorf("failed to generate file ID: %v", err)
+	}
+
 	// Prepare headers for each shard.
+	keyCheck := keyCheckValue(key, iv, fileID)
 	headers := make([]header.Header, totalShards)
 	for i := 0; i < totalShards; i++ {
 		headers[i] = header.Header{
 			ShardIndex:     i,
 			ShardCount:     totalShards,
+			FileID:         fileID,
+			FileGeneration: e.opts.Generation,
 			FileKey:        fileKeySplit[i],
-			FileHash:       make([]byte, 32),
-			FileSize:       0,
+			KeyCheck:       keyCheck,
 			EncryptedSize:  0,
-			CompressedSize: 0,
 			RSBlockSize:    rsBlockSize,
 			AESBlockSize:   aesBlockSize,
+			DataShards:     int(e.opts.DataShards),
+			Trailer:        e.opts.KeepTrailer || e.opts.Streaming,
+			Footer:         e.opts.Streaming,
 			IsComplete:     false,
 		}
+	}
 
-		// Write the header to the shard.
-		b, err := headers[i].Encode()
-		if err != nil {
-			return nil, fmt.Errorf("failed to encode header: %v", err)
+	// Make sure the metadata fits in the complete header before encoding the
+	// data, by trying to encode a header with the largest possible values.
+	if metadata != nil || storeDigests {
+		trial := headers[0]
+		priv := &header.Private{
+			FileHash:       make([]byte, sha256.Size),
+			FileSize:       math.MaxUint64,
+			CompressedSize: math.MaxUint64,
+			Metadata:       metadata,
 		}
-		if _, err := shards[i].Write(b); err != nil {
-			return nil, fmt.Errorf("failed to write header: %v", err)
+		if storeDigests {
+			priv.Digests = storedSums(extraDigests.sums())
+		}
+		if err := trial.SealPrivate(fileKey, priv); err != nil {
+			return nil, fmt.Errorf("failed to seal header: %v", err)
+		}
+		trial.EncryptedSize = math.MaxUint64
+		trial.IsComplete = true
+		trial.MAC = make([]byte, sha256.Size)
+		if _, err := trial.Encode(); err != nil {
+			return nil, ErrMetadataTooLarge
 		}
 	}
 
+	// In streaming mode, the shards are final as they are written, so their
+	// digests can be computed on the fly.
+	var timings StageTimings
+	var shardHashTime time.Duration
+	var digests []*digestWriter
+	outputs := shards
+	if e.opts.ShardDigests && e.opts.Streaming {
+		digests = make([]*digestWriter, totalShards)
+		outputs = make([]io.Writer, totalShards)
+		for i := range shards {
+			digests[i] = newDigestWriter(shards[i], &shardHashTime)
+			outputs[i] = digests[i]
+		}
+	}
+
+	// Write the headers to the shards.
+	stepStart := time.Now()
+	if err := writeHeaders(outputs, headers); err != nil {
+		return nil, err
+	}
+	headerTime := time.Since(stepStart)
+
 	// Prepare the Reed-Solomon encoder.
 	encRS, err := reedsolomon.NewEncoder(
 		int(e.opts.DataShards), int(e.opts.ParityShards), rsBlockSize,
@@ -104,11 +259,17 @@ func (e *Encoder) Encode(data io.Reader, shards []io.Writer, key []byte, iv []by
 		return nil, fmt.Errorf("failed to create Reed-Solomon encoder: %v", err)
 	}
 
-	// Prepare the Reed-Solomon writer.
-	wRS := reedsolomon.NewWriter(shards, encRS)
+	// Prepare the Reed-Solomon writer. Every writer in the pipeline is timed,
+	// so that the time spent in each stage can be told apart.
+	var writeTime, rsTime, aesTime, paddingTime time.Duration
+	dataWriters := make([]io.Writer, totalShards)
+	for i := range outputs {
+		dataWriters[i] = &timedWriter{w: outputs[i], d: &writeTime}
+	}
+	wRS := reedsolomon.NewWriter(dataWriters, encRS)
 
 	// Prepare the AES writer.
-	wAES, err := aesgcm.NewWriter(wRS, fileKey, aesBlockSize)
+	wAES, err := aesgcm.NewWriter(&timedWriter{w: wRS, d: &rsTime}, fileKey, aesBlockSize)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create AES writer: %v", err)
 	}
@@ -118,36 +279,51 @@ func (e *Encoder) Encode(data io.Reader, shards []io.Writer, key []byte, iv []by
 	if err != nil {
 		return nil, fmt.Errorf("failed to create zstd writer: %v", err)
 	}
-	wZstd, err := seekable.NewWriter(wAES, encZstd)
+	wZstd, err := seekable.NewWriter(&timedWriter{w: wAES, d: &aesTime}, encZstd)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create zstd writer: %v", err)
 	}
 
 	// Start encoding
+	progress := e.newProgress(StageEncode, inputSize(data))
 	chunk := make([]byte, rsBlockSize)
 	hash := sha256.New()
 	fileSize := uint64(0)
 
 	for {
-		// Read a block of data
-		n, err := data.Read(chunk)
-		if err != nil {
+		// Stop if the context is done.
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// Read a block of data. Readers such as pipes may return less than a
+		// block at a time, so only stop at the end of the data.
+		stepStart = time.Now()
+		n, err := io.ReadFull(data, chunk)
+		timings.Read += time.Since(stepStart)
+		if err != nil && err != io.ErrUnexpectedEOF {
 			if err == io.EOF {
 				break
 			}
 			return nil, fmt.Errorf("failed to read data: %v", err)
 		}
 		fileSize += uint64(n)
+		progress.add(int64(n))
 
 		// Encode
+		stepStart = time.Now()
 		if _, err := wZstd.Write(chunk[:n]); err != nil {
 			return nil, fmt.Errorf("failed to write to compressor: %v", err)
 		}
+		timings.Compress += time.Since(stepStart)
 
 		// Update the hash
+		stepStart = time.Now()
 		if _, err := hash.Write(chunk[:n]); err != nil {
 			return nil, fmt.Errorf("failed to hash chunk: %v", err)
 		}
+		extraDigests.Write(chunk[:n])
+		timings.Hash += time.Since(stepStart)
 
 		if n < rsBlockSize {
 			break
@@ -155,47 +331,120 @@ func (e *Encoder) Encode(data io.Reader, shards []io.Writer, key []byte, iv []by
 	}
 
 	// Close the writers
+	stepStart = time.Now()
 	if err := wZstd.Close(); err != nil {
 		return nil, fmt.Errorf("failed to close compressor writer: %v", err)
 	}
 	if err := encZstd.Close(); err != nil {
 		return nil, fmt.Errorf("failed to close compressor encoder: %v", err)
 	}
+	timings.Compress += time.Since(stepStart)
+
+	// Pad the compressed data according to the padding policy. The padding is
+	// encrypted along with the data, and is ignored when decoding as it comes
+	// after the end of the compressed data.
+	compressedSize := wAES.(*aesgcm.AESWriter).GetRead()
+	padding := paddedSize(compressedSize, e.opts.Padding, e.opts.PaddingMultiple) - compressedSize
+	stepStart = time.Now()
+	for padding > 0 {
+		n := uint64(len(chunk))
+		if padding < n {
+			n = padding
+		}
+		for i := range chunk[:n] {
+			chunk[i] = 0
+		}
+		if _, err := wAES.Write(chunk[:n]); err != nil {
+			return nil, fmt.Errorf("failed to write padding: %v", err)
+		}
+		padding -= n
+	}
 	if err := wAES.Close(); err != nil {
 		return nil, fmt.Errorf("failed to close aes writer: %v", err)
 	}
+	paddingTime = time.Since(stepStart)
+	stepStart = time.Now()
 	if err := wRS.Close(); err != nil {
 		return nil, fmt.Errorf("failed to close reed-solomon writer: %v", err)
 	}
+	rsCloseTime := time.Since(stepStart)
 
-	// Write the complete header to the end of the file.
+	// Seal the fields that reveal information about the plaintext with the
+	// file key.
 	digest := hash.Sum(nil)
+	sums := extraDigests.sums()
+	priv := &header.Private{
+		FileHash:       digest,
+		FileSize:       fileSize,
+		CompressedSize: compressedSize,
+		Metadata:       metadata,
+	}
+	if storeDigests {
+		priv.Digests = storedSums(sums)
+	}
+	if err := headers[0].SealPrivate(fileKey, priv); err != nil {
+		return nil, fmt.Errorf("failed to seal header: %v", err)
+	}
+
+	// Write the complete header to the end of the file.
 	for i := 0; i < totalShards; i++ {
-		headers[i].FileHash = digest
-		headers[i].FileSize = fileSize
+		headers[i].Sealed = headers[0].Sealed
 		headers[i].EncryptedSize = wAES.(*aesgcm.AESWriter).GetWritten()
-		headers[i].CompressedSize = wAES.(*aesgcm.AESWriter).GetRead()
 		headers[i].IsComplete = true
+		headers[i].MAC = headers[i].ComputeMAC(fileKey)
+	}
 
-		// Write the updated header to the end of the shard.
-		b, err := headers[i].Encode()
-		if err != nil {
-			return nil, fmt.Errorf("failed to encode header: %v", err)
-		}
-		if _, err := shards[i].Write(b); err != nil {
-			return nil, fmt.Errorf("failed to write header: %v", err)
-		}
+	// Write the complete headers to the shards.
+	stepStart = time.Now()
+	patched, err := writeCompleteHeaders(outputs, headers)
+	if err != nil {
+		return nil, err
+	}
+	headerTime += time.Since(stepStart)
+	shardResults, err := e.shardResults(shards, headers, patched, digests, &shardHashTime)
+	if err != nil {
+		return nil, err
+	}
+	progress.finish()
+	e.recordStage(StageEncode, start, int64(fileSize),
+		int64(totalShards)*shardSize(&headers[0]))
+	if compressedSize > 0 {
+		e.metrics().ObserveHistogram(MetricCompressionRatio, StageEncode,
+			float64(fileSize)/float64(compressedSize))
+	}
+
+	// Work out the time spent in each stage, leaving out the time spent in the
+	// stages that come after it. Only the time the compressor spent writing to
+	// the AES writer is taken out of Compress, the padding and the closing of
+	// the AES writer are charged to Encrypt.
+	timings.Compress -= aesTime
+	timings.Encrypt = aesTime + paddingTime - rsTime
+	timings.ErasureCode = rsTime + rsCloseTime - writeTime
+	timings.Write = writeTime + headerTime
+	if digests != nil {
+		timings.Write -= shardHashTime
 	}
+	timings.Hash += shardHashTime
+	timings.Total = time.Since(start)
+	e.recordTimings(timings)
 
 	return &EncodingResult{
-		FileSize: fileSize,
-		FileHash: digest,
+		FileSize:       fileSize,
+		FileHash:       digest,
+		FileID:         fileID,
+		CompressedSize: compressedSize,
+		EncryptedSize:  headers[0].EncryptedSize,
+		Shards:         shardResults,
+		Timings:        timings,
+		Digests:        sums,
 	}, nil
 }
 
 // FinalizeHeader rewrites the shard header with the one located at the end of
-// the shard. If the provided shard is an *os.File, the header at the end of the
-// file will be truncated.
+// the shard. If the provided shard has a Truncate method, such as *os.File, the
+// header at the end of the file will be truncated, unless the encoder was told
+// to keep it as a trailer with the KeepTrailer option. Shards that already have
+// a complete header are left untouched, so it is safe to call on any shard.
 func (e *Encoder) FinalizeHeader(shard io.ReadWriteSeeker) error {
 	// Seek to the start of the shard.
 	if _, err := shard.Seek(0, io.SeekStart); err != nil {
@@ -203,30 +452,32 @@ func (e *Encoder) FinalizeHeader(shard io.ReadWriteSeeker) error {
 	}
 
 	// Try to read the header at the start
-	headerBuf := make([]byte, header.HeaderSize)
-	if _, err := shard.Read(headerBuf); err != nil {
+	hdr, err := header.Read(shard)
+	if err != nil {
 		return fmt.Errorf("failed to read header at start of shard: %v", err)
 	}
 
-	// Parse the header at the start
-	hdr := header.NewHeader()
-	if err := hdr.Decode(headerBuf); err != nil {
-		return fmt.Errorf("failed to decode header at start of shard: %v", err)
-	}
-
 	// Skip if the header is already complete
 	if hdr.IsComplete {
 		return nil
 	}
 
-	// Seek to the end of the shard
-	hdrOffset, err := shard.Seek(-int64(header.HeaderSize), io.SeekEnd)
+	// Seek to the end of the shard. The header at the end has the same size as
+	// the one at the start, and is followed by a locator if it is kept as a
+	// trailer.
+	headerBuf := make([]byte, hdr.EncodedSize())
+	keepTrailer := hdr.Trailer
+	end := int64(len(headerBuf))
+	if keepTrailer {
+		end += locatorSize
+	}
+	hdrOffset, err := shard.Seek(-end, io.SeekEnd)
 	if err != nil {
 		return fmt.Errorf("failed to seek to end of shard: %v", err)
 	}
 
 	// Read the header at the end
-	if _, err := shard.Read(headerBuf); err != nil {
+	if _, err := io.ReadFull(shard, headerBuf); err != nil {
 		return fmt.Errorf("failed to read header at end of shard: %v", err)
 	}
 
@@ -249,7 +500,7 @@ func (e *Encoder) FinalizeHeader(shard io.ReadWriteSeeker) error {
 	}
 
 	// Try to truncate the ending header
-	if file, ok := shard.(*os.File); ok {
+	if file, ok := shard.(truncater); ok && !keepTrailer {
 		if err := file.Truncate(hdrOffset); err != nil {
 			return fmt.Errorf("failed to truncate shard: %v", err)
 		}
@@ -2,17 +2,27 @@ package stitch_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/OhanaFS/stitch"
+	"github.com/OhanaFS/stitch/header"
+	"github.com/OhanaFS/stitch/reedsolomon"
 	"github.com/OhanaFS/stitch/util"
 	"github.com/OhanaFS/stitch/util/debug"
 	"github.com/stretchr/testify/assert"
+	"lukechampine.com/blake3"
 )
 
 // A simple example to demonstrate how to use the Encoder and ReadSeeker.
@@ -119,3 +129,746 @@ func TestEncodeDecode(t *testing.T) {
 	// }
 	// runTest(dddd)
 }
+
+func TestHeaderAuthentication(t *testing.T) {
+	assert := assert.New(t)
+
+	input := make([]byte, 10000)
+	_, err := rand.Read(input)
+	assert.NoError(err)
+
+	shards := make([]*util.Membuf, 3)
+	shardWriters := make([]io.Writer, 3)
+	shardReaders := make([]io.ReadSeeker, 3)
+	for i := 0; i < 3; i++ {
+		shards[i] = util.NewMembuf()
+		shardWriters[i] = shards[i]
+		shardReaders[i] = shards[i]
+	}
+
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+	})
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	_, err = encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+	assert.NoError(err)
+	for _, shard := range shards {
+		assert.NoError(encoder.FinalizeHeader(shard))
+	}
+
+	// Rewrite a header with a wrong but well-formed encrypted size.
+	hdr := header.NewHeader()
+	assert.NoError(hdr.Decode(shards[0].Bytes()))
+	hdr.EncryptedSize -= 4096
+	b, err := hdr.Encode()
+	assert.NoError(err)
+	_, err = shards[0].Seek(0, io.SeekStart)
+	assert.NoError(err)
+	_, err = shards[0].Write(b)
+	assert.NoError(err)
+
+	// The shard should be ignored, and the data still decoded correctly.
+	reader, err := encoder.NewReadSeeker(shardReaders, key, iv)
+	assert.NoError(err)
+	output, err := io.ReadAll(reader)
+	assert.NoError(err)
+	assert.Equal(input, output)
+
+	// Stripping the MAC from a tampered header shouldn't get it accepted either,
+	// as the other headers of the file have one.
+	logger := &testLogger{}
+	encoder = stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+		Logger:       logger,
+	})
+	for i := range shards {
+		shards[i] = util.NewMembuf()
+		shardWriters[i] = shards[i]
+		shardReaders[i] = shards[i]
+	}
+	_, err = encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+	assert.NoError(err)
+	assert.NoError(hdr.Decode(shards[2].Bytes()))
+	hdr.ShardIndex = 1
+	hdr.MAC = nil
+	b, err = hdr.Encode()
+	assert.NoError(err)
+	_, err = shards[2].WriteAt(b, 0)
+	assert.NoError(err)
+
+	reader, err = encoder.NewReadSeeker(shardReaders, key, iv)
+	assert.NoError(err)
+	output, err = io.ReadAll(reader)
+	assert.NoError(err)
+	assert.Equal(input, output)
+	assert.Contains(strings.Join(logger.events, "\n"), "shard header failed authentication")
+}
+
+func TestShardsFromDifferentFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+	})
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	// Encode two different versions of a file with the same key.
+	encode := func(input []byte) []*util.Membuf {
+		shards := make([]*util.Membuf, 3)
+		shardWriters := make([]io.Writer, 3)
+		for i := range shards {
+			shards[i] = util.NewMembuf()
+			shardWriters[i] = shards[i]
+		}
+		_, err := encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+		assert.NoError(err)
+		for _, shard := range shards {
+			assert.NoError(encoder.FinalizeHeader(shard))
+		}
+		return shards
+	}
+	input1 := make([]byte, 10000)
+	_, err := rand.Read(input1)
+	assert.NoError(err)
+	input2 := make([]byte, 10000)
+	_, err = rand.Read(input2)
+	assert.NoError(err)
+	shards1 := encode(input1)
+	shards2 := encode(input2)
+
+	// A stray shard of the first version should be left out.
+	readers := []io.ReadSeeker{shards1[0], shards2[1], shards2[2]}
+	reader, err := encoder.NewReadSeeker(readers, key, iv)
+	assert.NoError(err)
+	output, err := io.ReadAll(reader)
+	assert.NoError(err)
+	assert.Equal(input2, output)
+
+	vres, err := encoder.VerifyIntegrity(readers)
+	assert.NoError(err)
+	assert.Equal([]int{0}, vres.ForeignShards)
+
+	// Without a clear majority, the shards should be rejected.
+	readers = []io.ReadSeeker{shards1[0], shards2[1]}
+	_, err = encoder.NewReadSeeker(readers, key, iv)
+	assert.ErrorIs(err, stitch.ErrShardFromDifferentFile)
+}
+
+func TestMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	metadata := &header.Metadata{
+		Name:        "report.pdf",
+		ContentType: "application/pdf",
+		Mode:        0640,
+		ModTime:     time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC),
+		Extra:       map[string]string{"user.origin": "scanner"},
+	}
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+		Metadata:     metadata,
+	})
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	shards := make([]*util.Membuf, 3)
+	shardWriters := make([]io.Writer, 3)
+	shardReaders := make([]io.ReadSeeker, 3)
+	for i := 0; i < 3; i++ {
+		shards[i] = util.NewMembuf()
+		shardWriters[i] = shards[i]
+		shardReaders[i] = shards[i]
+	}
+	_, err := encoder.Encode(bytes.NewReader([]byte("hello")), shardWriters, key, iv)
+	assert.NoError(err)
+	for _, shard := range shards {
+		assert.NoError(encoder.FinalizeHeader(shard))
+	}
+
+	// The metadata should be encrypted.
+	assert.NotContains(string(shards[0].Bytes()), metadata.Name)
+
+	// The metadata should be returned as it was supplied.
+	res, err := encoder.ReadMetadata(shardReaders, key, iv)
+	assert.NoError(err)
+	assert.Equal(metadata.Name, res.Name)
+	assert.Equal(metadata.ContentType, res.ContentType)
+	assert.Equal(metadata.Mode, res.Mode)
+	assert.True(metadata.ModTime.Equal(res.ModTime))
+	assert.Equal(metadata.Extra, res.Extra)
+
+	// Metadata supplied with each file takes the place of the option, which is
+	// left as it was.
+	other := &header.Metadata{Name: "other.txt"}
+	for i := range shards {
+		shards[i] = util.NewMembuf()
+		shardWriters[i] = shards[i]
+		shardReaders[i] = shards[i]
+	}
+	_, err = encoder.EncodeWithMetadata(context.Background(),
+		bytes.NewReader([]byte("hello")), shardWriters, key, iv, other)
+	assert.NoError(err)
+	for _, shard := range shards {
+		assert.NoError(encoder.FinalizeHeader(shard))
+	}
+	res, err = encoder.ReadMetadata(shardReaders, key, iv)
+	assert.NoError(err)
+	assert.Equal(other.Name, res.Name)
+	assert.Equal("report.pdf", metadata.Name)
+
+	// Metadata that doesn't fit in the header should be rejected up front.
+	encoder = stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+		Metadata:     &header.Metadata{Name: string(make([]byte, header.DefaultSize))},
+	})
+	_, err = encoder.Encode(bytes.NewReader([]byte("hello")),
+		[]io.Writer{util.NewMembuf(), util.NewMembuf(), util.NewMembuf()}, key, iv)
+	assert.ErrorIs(err, stitch.ErrMetadataTooLarge)
+}
+
+func TestKeepTrailer(t *testing.T) {
+	assert := assert.New(t)
+
+	input := make([]byte, 20000)
+	_, err := rand.Read(input)
+	assert.NoError(err)
+
+	// Use files, which would normally have their trailing header truncated.
+	dir := t.TempDir()
+	shards := make([]*os.File, 3)
+	shardWriters := make([]io.Writer, 3)
+	shardReaders := make([]io.ReadSeeker, 3)
+	for i := 0; i < 3; i++ {
+		shards[i], err = os.Create(fmt.Sprintf("%s/shard%d", dir, i))
+		assert.NoError(err)
+		defer shards[i].Close()
+		shardWriters[i] = shards[i]
+		shardReaders[i] = shards[i]
+	}
+
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+		KeepTrailer:  true,
+	})
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	_, err = encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+	assert.NoError(err)
+	for _, shard := range shards {
+		assert.NoError(encoder.FinalizeHeader(shard))
+	}
+
+	// The trailer shouldn't be mistaken for data.
+	_, err = shards[0].Seek(0, io.SeekStart)
+	assert.NoError(err)
+	sres, err := stitch.VerifyShardIntegrity(shards[0])
+	assert.NoError(err)
+	assert.Equal(sres.BlocksCount, sres.BlocksFound)
+	assert.Empty(sres.BrokenBlocks)
+
+	// Wipe the start of the header of every shard.
+	for _, shard := range shards {
+		_, err = shard.WriteAt(make([]byte, 64), 0)
+		assert.NoError(err)
+	}
+
+	// The data should still be readable using the trailers.
+	reader, err := encoder.NewReadSeeker(shardReaders, key, iv)
+	assert.NoError(err)
+	output, err := io.ReadAll(reader)
+	assert.NoError(err)
+	assert.Equal(input, output)
+}
+
+func TestStreaming(t *testing.T) {
+	assert := assert.New(t)
+
+	input := make([]byte, 20000)
+	_, err := rand.Read(input)
+	assert.NoError(err)
+
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+		Streaming:    true,
+	})
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	// Encode to writers that can't seek.
+	buffers := make([]*bytes.Buffer, 3)
+	shardWriters := make([]io.Writer, 3)
+	for i := range buffers {
+		buffers[i] = &bytes.Buffer{}
+		shardWriters[i] = struct{ io.Writer }{buffers[i]}
+	}
+	_, err = encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+	assert.NoError(err)
+
+	// The shards should be usable without being finalized.
+	shardReaders := make([]io.ReadSeeker, 3)
+	for i, buf := range buffers {
+		shardReaders[i] = bytes.NewReader(buf.Bytes())
+	}
+	reader, err := encoder.NewReadSeeker(shardReaders, key, iv)
+	assert.NoError(err)
+	output, err := io.ReadAll(reader)
+	assert.NoError(err)
+	assert.Equal(input, output)
+
+	vres, err := encoder.VerifyIntegrity(shardReaders)
+	assert.NoError(err)
+	assert.True(vres.AllGood)
+	assert.True(vres.FullyReadable)
+}
+
+func TestEncodingResult(t *testing.T) {
+	assert := assert.New(t)
+
+	input := make([]byte, 20000)
+	_, err := rand.Read(input)
+	assert.NoError(err)
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+	castagnoli := crc32.MakeTable(crc32.Castagnoli)
+
+	for _, streaming := range []bool{false, true} {
+		encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+			DataShards:   2,
+			ParityShards: 1,
+			KeyThreshold: 2,
+			Streaming:    streaming,
+			ShardDigests: true,
+		})
+
+		// Encode to writers that support WriteAt, so that the shards are either
+		// patched in place or written in a single pass.
+		shards := make([]*util.Membuf, 3)
+		shardWriters := make([]io.Writer, 3)
+		for i := range shards {
+			shards[i] = util.NewMembuf()
+			shardWriters[i] = shards[i]
+		}
+		result, err := encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+		assert.NoError(err)
+
+		assert.Equal(uint64(len(input)), result.FileSize)
+		assert.Len(result.FileID, 16)
+		assert.NotZero(result.CompressedSize)
+		assert.NotZero(result.EncryptedSize)
+		assert.NotZero(result.Timings.Total)
+
+		// The sizes and digests should match the finished shards.
+		assert.Len(result.Shards, 3)
+		for i, shard := range result.Shards {
+			data := shards[i].Bytes()
+			sum := sha256.Sum256(data)
+			assert.Equal(i, shard.Index)
+			assert.Equal(int64(len(data)), shard.Size)
+			assert.Equal(sum[:], shard.SHA256)
+			assert.Equal(crc32.Checksum(data, castagnoli), shard.CRC32C)
+		}
+	}
+}
+
+func TestStageTimings(t *testing.T) {
+	assert := assert.New(t)
+
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	// Padding makes the AES writer do most of its work after the compressor
+	// is done, which shouldn't be taken out of the time spent compressing.
+	input := make([]byte, 70000)
+	_, err := rand.Read(input)
+	assert.NoError(err)
+	for _, streaming := range []bool{false, true} {
+		encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+			DataShards:   2,
+			ParityShards: 1,
+			KeyThreshold: 2,
+			Streaming:    streaming,
+			ShardDigests: true,
+			Padding:      stitch.PaddingPowerOfTwo,
+		})
+		shardWriters := []io.Writer{util.NewMembuf(), util.NewMembuf(), util.NewMembuf()}
+		result, err := encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+		assert.NoError(err)
+
+		timings := result.Timings
+		for _, d := range []time.Duration{
+			timings.Read, timings.Hash, timings.Compress, timings.Encrypt,
+			timings.ErasureCode, timings.Write, timings.Total,
+		} {
+			assert.GreaterOrEqual(d, time.Duration(0))
+		}
+		assert.LessOrEqual(timings.Read+timings.Hash+timings.Compress+
+			timings.Encrypt+timings.ErasureCode+timings.Write, timings.Total)
+	}
+}
+
+func TestDigests(t *testing.T) {
+	assert := assert.New(t)
+
+	input := make([]byte, 20000)
+	_, err := rand.Read(input)
+	assert.NoError(err)
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	md5Sum := md5.Sum(input)
+	sha1Sum := sha1.Sum(input)
+	blake3Sum := blake3.Sum256(input)
+	crc := crc32.Checksum(input, crc32.MakeTable(crc32.Castagnoli))
+	expected := map[stitch.DigestAlgorithm][]byte{
+		stitch.DigestMD5:    md5Sum[:],
+		stitch.DigestSHA1:   sha1Sum[:],
+		stitch.DigestCRC32C: {byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc)},
+		stitch.DigestBLAKE3: blake3Sum[:],
+	}
+
+	encode := func(store bool) ([]*util.Membuf, *stitch.Encoder) {
+		encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+			DataShards:   2,
+			ParityShards: 1,
+			KeyThreshold: 2,
+			Digests: []stitch.DigestAlgorithm{
+				stitch.DigestMD5, stitch.DigestSHA1, stitch.DigestCRC32C, stitch.DigestBLAKE3,
+			},
+			StoreDigests: store,
+		})
+		shards := make([]*util.Membuf, 3)
+		shardWriters := make([]io.Writer, 3)
+		for i := range shards {
+			shards[i] = util.NewMembuf()
+			shardWriters[i] = shards[i]
+		}
+		result, err := encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+		assert.NoError(err)
+		assert.Equal(expected, result.Digests)
+		return shards, encoder
+	}
+	readers := func(shards []*util.Membuf) []io.ReadSeeker {
+		shardReaders := make([]io.ReadSeeker, len(shards))
+		for i, shard := range shards {
+			shardReaders[i] = bytes.NewReader(shard.Bytes())
+		}
+		return shardReaders
+	}
+
+	// The digests should only be stored in the header if requested.
+	shards, encoder := encode(false)
+	digests, err := encoder.ReadDigests(readers(shards), key, iv)
+	assert.NoError(err)
+	assert.Nil(digests)
+
+	shards, encoder = encode(true)
+	digests, err = encoder.ReadDigests(readers(shards), key, iv)
+	assert.NoError(err)
+	assert.Equal(expected, digests)
+
+	// Decoding should check the data against the stored digests.
+	output := &bytes.Buffer{}
+	shardReaders := make([]io.Reader, 3)
+	for i, r := range readers(shards) {
+		shardReaders[i] = r
+	}
+	assert.NoError(encoder.Decode(output, shardReaders, key, iv))
+	assert.Equal(input, output.Bytes())
+
+	// Unknown algorithms should be rejected before anything is written.
+	encoder = stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+		Digests:      []stitch.DigestAlgorithm{"whirlpool"},
+	})
+	buffers := []io.Writer{&bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}}
+	_, err = encoder.Encode(bytes.NewReader(input), buffers, key, iv)
+	assert.Error(err)
+	assert.Zero(buffers[0].(*bytes.Buffer).Len())
+}
+
+func TestPatchHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	input := make([]byte, 20000)
+	_, err := rand.Read(input)
+	assert.NoError(err)
+
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+	})
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	// Encode to writers that support WriteAt.
+	shards := make([]*util.Membuf, 3)
+	shardWriters := make([]io.Writer, 3)
+	shardReaders := make([]io.ReadSeeker, 3)
+	for i := range shards {
+		shards[i] = util.NewMembuf()
+		shardWriters[i] = shards[i]
+		shardReaders[i] = shards[i]
+	}
+	_, err = encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+	assert.NoError(err)
+
+	// The headers should have been patched in place, without a copy at the end.
+	for _, shard := range shards {
+		hdr, err := header.Read(bytes.NewReader(shard.Bytes()))
+		assert.NoError(err)
+		assert.True(hdr.IsComplete)
+		assert.Equal(0, (shard.Len()-hdr.EncodedSize())%
+			(4096+reedsolomon.BlockOverhead))
+	}
+
+	// The shards should be usable without being finalized.
+	reader, err := encoder.NewReadSeeker(shardReaders, key, iv)
+	assert.NoError(err)
+	output, err := io.ReadAll(reader)
+	assert.NoError(err)
+	assert.Equal(input, output)
+
+	// Finalizing them anyway should have no effect.
+	for _, shard := range shards {
+		n := shard.Len()
+		assert.NoError(encoder.FinalizeHeader(shard))
+		assert.Equal(n, shard.Len())
+	}
+}
+
+func TestDecodeStream(t *testing.T) {
+	assert := assert.New(t)
+
+	input := make([]byte, 50000)
+	_, err := rand.Read(input)
+	assert.NoError(err)
+
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+	})
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	// Encode from a reader that returns short reads.
+	shards := make([]*util.Membuf, 3)
+	shardWriters := make([]io.Writer, 3)
+	for i := range shards {
+		shards[i] = util.NewMembuf()
+		shardWriters[i] = shards[i]
+	}
+	res, err := encoder.Encode(iotest.HalfReader(bytes.NewReader(input)),
+		shardWriters, key, iv)
+	assert.NoError(err)
+	assert.Equal(uint64(len(input)), res.FileSize)
+
+	// Decode from streams that can't seek, and also return short reads.
+	streams := func(idx ...int) []io.Reader {
+		readers := make([]io.Reader, len(idx))
+		for i, j := range idx {
+			readers[i] = iotest.HalfReader(bytes.NewReader(shards[j].Bytes()))
+		}
+		return readers
+	}
+	output := &bytes.Buffer{}
+	assert.NoError(encoder.Decode(output, streams(2, 0, 1), key, iv))
+	assert.Equal(input, output.Bytes())
+
+	// A missing shard should be reconstructed.
+	output.Reset()
+	assert.NoError(encoder.Decode(output, streams(1, 2), key, iv))
+	assert.Equal(input, output.Bytes())
+
+	// Too many missing shards.
+	output.Reset()
+	assert.ErrorIs(encoder.Decode(output, streams(1), key, iv),
+		stitch.ErrNotEnoughShards)
+
+	// A shard passed twice only counts once, even if the file key can be
+	// reconstructed from fewer shards than the data.
+	encoder = stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   3,
+		ParityShards: 1,
+		KeyThreshold: 2,
+	})
+	shards = make([]*util.Membuf, 4)
+	shardWriters = make([]io.Writer, 4)
+	for i := range shards {
+		shards[i] = util.NewMembuf()
+		shardWriters[i] = shards[i]
+	}
+	_, err = encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+	assert.NoError(err)
+	output.Reset()
+	assert.ErrorIs(encoder.Decode(output, streams(0, 1, 1), key, iv),
+		stitch.ErrNotEnoughShards)
+	output.Reset()
+	assert.NoError(encoder.Decode(output, streams(0, 1, 1, 3), key, iv))
+	assert.Equal(input, output.Bytes())
+}
+
+func TestDecodeStreaming(t *testing.T) {
+	assert := assert.New(t)
+
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	for _, padding := range []stitch.PaddingPolicy{stitch.PaddingNone, stitch.PaddingPowerOfTwo} {
+		encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+			DataShards:   2,
+			ParityShards: 1,
+			KeyThreshold: 2,
+			Streaming:    true,
+			Padding:      padding,
+			Digests:      []stitch.DigestAlgorithm{stitch.DigestMD5},
+			StoreDigests: true,
+		})
+
+		for _, size := range []int{0, 20000, 300000} {
+			input := make([]byte, size)
+			_, err := rand.Read(input)
+			assert.NoError(err)
+
+			// Encode to writers that can't seek, so the complete header is only
+			// in the trailer.
+			buffers := make([]*bytes.Buffer, 3)
+			shardWriters := make([]io.Writer, 3)
+			for i := range buffers {
+				buffers[i] = &bytes.Buffer{}
+				shardWriters[i] = struct{ io.Writer }{buffers[i]}
+			}
+			_, err = encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+			assert.NoError(err)
+
+			streams := func(idx ...int) []io.Reader {
+				readers := make([]io.Reader, len(idx))
+				for i, j := range idx {
+					readers[i] = iotest.HalfReader(bytes.NewReader(buffers[j].Bytes()))
+				}
+				return readers
+			}
+			output := &bytes.Buffer{}
+			assert.NoError(encoder.Decode(output, streams(0, 1, 2), key, iv))
+			assert.True(bytes.Equal(input, output.Bytes()))
+
+			// A missing shard should be reconstructed.
+			output.Reset()
+			assert.NoError(encoder.Decode(output, streams(2, 0), key, iv))
+			assert.True(bytes.Equal(input, output.Bytes()))
+		}
+	}
+
+	// A tampered trailer should be caught before the hash is compared.
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+		Streaming:    true,
+	})
+	input := make([]byte, 20000)
+	_, err := rand.Read(input)
+	assert.NoError(err)
+	buffers := make([]*bytes.Buffer, 3)
+	shardWriters := make([]io.Writer, 3)
+	for i := range buffers {
+		buffers[i] = &bytes.Buffer{}
+		shardWriters[i] = struct{ io.Writer }{buffers[i]}
+	}
+	_, err = encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+	assert.NoError(err)
+
+	readers := make([]io.Reader, 3)
+	for i, buf := range buffers {
+		shard := buf.Bytes()
+		trailer, err := header.Read(bytes.NewReader(shard[len(shard)-header.DefaultSize-16:]))
+		assert.NoError(err)
+		trailer.EncryptedSize++
+		b, err := trailer.Encode()
+		assert.NoError(err)
+		copy(shard[len(shard)-len(b)-16:], b)
+		readers[i] = bytes.NewReader(shard)
+	}
+	err = encoder.Decode(io.Discard, readers, key, iv)
+	assert.ErrorIs(err, stitch.ErrNoCompleteHeader)
+}
+
+func TestContext(t *testing.T) {
+	assert := assert.New(t)
+
+	input := make([]byte, 50000)
+	_, err := rand.Read(input)
+	assert.NoError(err)
+
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+	})
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	shards := make([]*util.Membuf, 3)
+	shardWriters := make([]io.Writer, 3)
+	shardReaders := make([]io.ReadSeeker, 3)
+	for i := range shards {
+		shards[i] = util.NewMembuf()
+		shardWriters[i] = shards[i]
+		shardReaders[i] = shards[i]
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Encoding should stop if the context is done.
+	_, err = encoder.EncodeContext(canceled, bytes.NewReader(input),
+		[]io.Writer{util.NewMembuf(), util.NewMembuf(), util.NewMembuf()}, key, iv)
+	assert.ErrorIs(err, context.Canceled)
+
+	_, err = encoder.EncodeContext(context.Background(), bytes.NewReader(input),
+		shardWriters, key, iv)
+	assert.NoError(err)
+
+	// Reading should stop once the context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, err := encoder.NewReadSeekerContext(ctx, shardReaders, key, iv)
+	assert.NoError(err)
+	buf := make([]byte, 1000)
+	_, err = io.ReadFull(reader, buf)
+	assert.NoError(err)
+	assert.Equal(input[:1000], buf)
+	cancel()
+	_, err = reader.Read(buf)
+	assert.ErrorIs(err, context.Canceled)
+
+	// Decoding and verifying should stop if the context is done.
+	err = encoder.DecodeContext(canceled, io.Discard, []io.Reader{
+		bytes.NewReader(shards[0].Bytes()),
+		bytes.NewReader(shards[1].Bytes()),
+		bytes.NewReader(shards[2].Bytes()),
+	}, key, iv)
+	assert.ErrorIs(err, context.Canceled)
+
+	_, err = encoder.VerifyIntegrityContext(canceled, shardReaders)
+	assert.ErrorIs(err, context.Canceled)
+}
@@ -0,0 +1,98 @@
+package stitch
+
+import (
+	"fmt"
+	"math"
+
+	aesgcm "github.com/OhanaFS/stitch/aes"
+	"github.com/OhanaFS/stitch/header"
+)
+
+const (
+	// zstdFrameOverhead is the largest number of bytes that zstd adds to each
+	// frame of at most rsBlockSize bytes: a frame header of up to 18 bytes, a
+	// 3-byte block header and a 4-byte checksum.
+	zstdFrameOverhead = 18 + 3 + 4
+	// seekTableEntrySize is the size of each entry in the seek table, which
+	// includes a checksum of the frame.
+	seekTableEntrySize = 12
+	// seekTableOverhead is the size of the skippable frame header and footer
+	// that wrap the seek table.
+	seekTableOverhead = 8 + 9
+)
+
+// SizeEstimate describes the worst-case size of the shards that Encode() would
+// write for a file.
+type SizeEstimate struct {
+	// CompressedSize is the size of the compressed data, including the seek
+	// table.
+	CompressedSize uint64
+	// PaddedSize is the size of the compressed data once it is padded according
+	// to the padding policy.
+	PaddedSize uint64
+	// EncryptedSize is the size of the encrypted data.
+	EncryptedSize uint64
+	// ShardSize is the size of each finalized shard.
+	ShardSize int64
+	// PeakShardSize is the largest size that a shard can reach before it is
+	// finalized, which happens when a complete header is appended to a shard
+	// that doesn't implement io.WriterAt.
+	PeakShardSize int64
+	// TotalSize is the combined size of all the finalized shards.
+	TotalSize int64
+}
+
+// EstimateShardSize returns the worst-case size of the shards for a file of the
+// given size, without encoding it. compressionRatio is the expected size of the
+// compressed data relative to the input, where 1 means that the input can't be
+// compressed, which gives an upper bound for any input. Ratios above 1 are
+// treated as 1, as zstd stores data that doesn't compress as is.
+func (e *Encoder) EstimateShardSize(plaintextSize uint64, compressionRatio float64) (
+	*SizeEstimate, error,
+) {
+	if math.IsNaN(compressionRatio) || compressionRatio <= 0 {
+		return nil, fmt.Errorf("invalid compression ratio: %v", compressionRatio)
+	}
+	if e.opts.Padding == PaddingMultiple && e.opts.PaddingMultiple == 0 {
+		return nil, ErrInvalidPadding
+	}
+	if e.opts.DataShards == 0 {
+		return nil, fmt.Errorf("invalid number of data shards: %d", e.opts.DataShards)
+	}
+	if compressionRatio > 1 {
+		compressionRatio = 1
+	}
+
+	// The input is compressed in frames of rsBlockSize bytes, followed by a
+	// seek table with an entry for each frame.
+	frames := (plaintextSize + rsBlockSize - 1) / rsBlockSize
+	payload := uint64(math.Ceil(float64(plaintextSize) * compressionRatio))
+	if payload > plaintextSize {
+		payload = plaintextSize
+	}
+	est := &SizeEstimate{}
+	est.CompressedSize = payload + frames*(zstdFrameOverhead+seekTableEntrySize) +
+		seekTableOverhead
+
+	// The padded data is encrypted in chunks of aesBlockSize bytes, with the
+	// last chunk padded to a whole chunk.
+	est.PaddedSize = paddedSize(est.CompressedSize, e.opts.Padding, e.opts.PaddingMultiple)
+	chunks := (est.PaddedSize + aesBlockSize - 1) / aesBlockSize
+	est.EncryptedSize = chunks * (aesBlockSize + aesgcm.Overhead)
+
+	// Work out the size of the shards from their complete header.
+	hdr := header.Header{
+		RSBlockSize:   rsBlockSize,
+		DataShards:    int(e.opts.DataShards),
+		EncryptedSize: est.EncryptedSize,
+		Trailer:       e.opts.KeepTrailer || e.opts.Streaming,
+	}
+	est.ShardSize = shardSize(&hdr)
+	est.PeakShardSize = est.ShardSize
+	if !hdr.Trailer {
+		est.PeakShardSize += int64(hdr.EncodedSize())
+	}
+	est.TotalSize = est.ShardSize * int64(e.opts.DataShards+e.opts.ParityShards)
+
+	return est, nil
+}
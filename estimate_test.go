@@ -0,0 +1,72 @@
+package stitch_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/OhanaFS/stitch"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimateShardSize(t *testing.T) {
+	assert := assert.New(t)
+
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	for _, opts := range []stitch.EncoderOptions{
+		{DataShards: 2, ParityShards: 1, KeyThreshold: 2},
+		{DataShards: 3, ParityShards: 2, KeyThreshold: 2, KeepTrailer: true},
+		{DataShards: 4, ParityShards: 2, KeyThreshold: 2, Padding: stitch.PaddingPadme},
+		{DataShards: 2, ParityShards: 2, KeyThreshold: 2, Streaming: true},
+	} {
+		opts := opts
+		encoder := stitch.NewEncoder(&opts)
+
+		for _, size := range []int{0, 1, 4096, 4097, 50000, 300000} {
+			// Incompressible data should never exceed the estimate.
+			input := make([]byte, size)
+			_, err := rand.Read(input)
+			assert.NoError(err)
+
+			est, err := encoder.EstimateShardSize(uint64(size), 1)
+			assert.NoError(err)
+
+			// Encode to writers that can't seek, so that the complete header is
+			// appended to each shard.
+			total := int(opts.DataShards + opts.ParityShards)
+			buffers := make([]*bytes.Buffer, total)
+			shardWriters := make([]io.Writer, total)
+			for i := range buffers {
+				buffers[i] = &bytes.Buffer{}
+				shardWriters[i] = buffers[i]
+			}
+			result, err := encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+			assert.NoError(err)
+
+			assert.LessOrEqual(result.CompressedSize, est.CompressedSize)
+			assert.LessOrEqual(result.EncryptedSize, est.EncryptedSize)
+			for i, buf := range buffers {
+				assert.LessOrEqual(int64(buf.Len()), est.PeakShardSize)
+				assert.LessOrEqual(result.Shards[i].Size, est.ShardSize)
+			}
+			assert.Equal(est.ShardSize*int64(total), est.TotalSize)
+		}
+	}
+
+	// A smaller compression ratio should never give a larger estimate.
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{DataShards: 2, ParityShards: 1})
+	full, err := encoder.EstimateShardSize(1<<30, 1)
+	assert.NoError(err)
+	half, err := encoder.EstimateShardSize(1<<30, 0.5)
+	assert.NoError(err)
+	assert.Less(half.TotalSize, full.TotalSize)
+	above, err := encoder.EstimateShardSize(1<<30, 2)
+	assert.NoError(err)
+	assert.Equal(full, above)
+
+	_, err = encoder.EstimateShardSize(1000, 0)
+	assert.Error(err)
+}
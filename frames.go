@@ -0,0 +1,176 @@
+package stitch
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// zstdFrameMagic starts every zstd frame.
+	zstdFrameMagic = 0xFD2FB528
+	// skippableFrameMagic starts a skippable frame, with the low 4 bits
+	// cleared.
+	skippableFrameMagic = 0x184D2A50
+	// seekTableMagic starts the skippable frame that holds the seek table,
+	// which is the last frame of the compressed data.
+	seekTableMagic = 0x184D2A5E
+)
+
+var errInvalidFrame = errors.New("invalid zstd frame")
+
+// frameReader reads the zstd frames of the compressed data up to the end of the
+// seek table, and then returns io.EOF, so that the data can be decompressed
+// without knowing its size in advance. Only the frame and block headers are
+// parsed, the rest of the data is passed through as is.
+type frameReader struct {
+	r io.Reader
+
+	// pending holds the headers that were parsed but not returned yet.
+	pending []byte
+	// remaining is the number of bytes to pass through before the next header.
+	remaining uint64
+	// next parses the next header.
+	next func() error
+	// done is set once the seek table has been passed through.
+	done bool
+	// n is the number of bytes returned so far.
+	n uint64
+}
+
+// Assert that frameReader implements the io.Reader interface.
+var _ io.Reader = &frameReader{}
+
+func newFrameReader(r io.Reader) *frameReader {
+	f := &frameReader{r: r}
+	f.next = f.readFrameHeader
+	return f
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	for len(f.pending) == 0 && f.remaining == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		if err := f.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	// Return the parsed headers first.
+	if len(f.pending) > 0 {
+		n := copy(p, f.pending)
+		f.pending = f.pending[n:]
+		f.n += uint64(n)
+		return n, nil
+	}
+
+	// Pass the data through.
+	if uint64(len(p)) > f.remaining {
+		p = p[:f.remaining]
+	}
+	n, err := f.r.Read(p)
+	f.remaining -= uint64(n)
+	f.n += uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// readHeader reads n more bytes of a header into pending.
+func (f *frameReader) readHeader(n int) ([]byte, error) {
+	start := len(f.pending)
+	f.pending = append(f.pending, make([]byte, n)...)
+	if _, err := io.ReadFull(f.r, f.pending[start:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return f.pending[start:], nil
+}
+
+// readFrameHeader parses the header of the next frame.
+func (f *frameReader) readFrameHeader() error {
+	b, err := f.readHeader(4)
+	if err != nil {
+		return err
+	}
+	magic := binary.LittleEndian.Uint32(b)
+
+	// Skippable frames are followed by their size.
+	if magic&0xFFFFFFF0 == skippableFrameMagic {
+		b, err := f.readHeader(4)
+		if err != nil {
+			return err
+		}
+		f.remaining = uint64(binary.LittleEndian.Uint32(b))
+		if magic == seekTableMagic {
+			f.done = true
+		}
+		return nil
+	}
+	if magic != zstdFrameMagic {
+		return errInvalidFrame
+	}
+
+	// Work out the size of the rest of the frame header from its descriptor.
+	b, err = f.readHeader(1)
+	if err != nil {
+		return err
+	}
+	descriptor := b[0]
+	singleSegment := descriptor&0x20 != 0
+	checksum := descriptor&0x04 != 0
+	size := []int{0, 1, 2, 4}[descriptor&0x03]
+	switch descriptor >> 6 {
+	case 0:
+		if singleSegment {
+			size++
+		}
+	case 1:
+		size += 2
+	case 2:
+		size += 4
+	case 3:
+		size += 8
+	}
+	if !singleSegment {
+		size++
+	}
+	if _, err := f.readHeader(size); err != nil {
+		return err
+	}
+
+	f.next = func() error { return f.readBlockHeader(checksum) }
+	return nil
+}
+
+// readBlockHeader parses the header of the next block of a frame.
+func (f *frameReader) readBlockHeader(checksum bool) error {
+	b, err := f.readHeader(3)
+	if err != nil {
+		return err
+	}
+	blockHeader := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+	last := blockHeader&1 != 0
+	switch (blockHeader >> 1) & 0x03 {
+	case 0, 2:
+		// Raw and compressed blocks are followed by their data.
+		f.remaining = uint64(blockHeader >> 3)
+	case 1:
+		// RLE blocks are followed by a single byte.
+		f.remaining = 1
+	default:
+		return errInvalidFrame
+	}
+
+	if last {
+		f.next = f.readFrameHeader
+		if checksum {
+			f.remaining += 4
+		}
+	}
+	return nil
+}
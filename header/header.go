@@ -1,9 +1,13 @@
 package header
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 
 	"github.com/vmihailenco/msgpack/v5"
 )
@@ -11,53 +15,256 @@ import (
 // Header describes the header of a shard. This struct only contains the actual
 // data. The full header of each shard is composed of the following:
 //
+// | Description                     | Length |
+// | ------------------------------- | ------ |
+// | magic bytes `STITCHv2`          | 8      |
+// | size of the whole header uint32 | 4      |
+// | length of the sections uint32   | 4      |
+// | sections                        | -      |
+// | CRC-32C of the preceding data   | 4      |
+// | padding to fill the header size | -      |
+//
+// Each section is composed of a uint16 type, a uint32 length, and the section
+// data. The fields of this struct are stored as MsgPack in the SectionCore
+// section. Sections of unknown types are kept in UnknownSections, so that they
+// are preserved when the header is rewritten.
+//
+// Version 1 headers have the following layout instead, and are still supported:
+//
 // | Description                   | Length |
 // | ----------------------------- | ------ |
 // | magic bytes `STITCHv1`        | 8      |
 // | length of header data uint16  | 2 		  |
 // | header data                   | -      |
-// | padding to fill to 1024 bytes | -      |
+// | padding to fill to 512 bytes  | -      |
+//
+// Version 1 headers are written byte-for-byte in this layout, so that they can
+// still be read by older versions. As a result, they don't have a checksum;
+// use MigrateHeader() to upgrade them to version 2.
 type Header struct {
 	// ShardIndex is the index of the shard.
 	ShardIndex int `msgpack:"i"`
 	// ShardCount is the total number of shards.
 	ShardCount int `msgpack:"c"`
-	// FileHash is the SHA256 hash of the whole file plaintext.
+	// FileID is a random identifier shared by every shard produced by the same
+	// encoding run.
+	FileID []byte `msgpack:"f"`
+	// FileGeneration is a user-supplied number that tells apart different
+	// versions of the same file.
+	FileGeneration uint64 `msgpack:"n"`
+	// FileHash is the SHA256 hash of the whole file plaintext. It is only used
+	// by headers without sealed data, see Private.
 	FileHash []byte `msgpack:"h"`
 	// FileKey is one shard of the AES key used to encrypt the file plaintext.
 	FileKey []byte `msgpack:"k"`
-	// FileSize is the size of the file plaintext.
+	// KeyCheck is a fingerprint of the user-supplied key that FileKey is
+	// wrapped with, and of FileID. It is used to tell a wrong key apart from
+	// corrupted key shards.
+	//
+	// As it is stored in plaintext, anyone holding a single shard can use it to
+	// test guesses of the user-supplied key offline, so that key must be
+	// random rather than derived from a password. Mixing in FileID keeps files
+	// wrapped with the same key from sharing a key check value, so it can't be
+	// used to link them together.
+	KeyCheck []byte `msgpack:"v"`
+	// KeyGeneration is incremented every time FileKey is rewrapped with a new
+	// key.
+	KeyGeneration uint32 `msgpack:"g"`
+	// PendingFileKey is the key split of an unfinished key rotation, which
+	// becomes FileKey with generation KeyGeneration+1 when the rotation is
+	// committed.
+	PendingFileKey []byte `msgpack:"p"`
+	// PendingKeyCheck is the key check value that belongs to PendingFileKey.
+	PendingKeyCheck []byte `msgpack:"q"`
+	// PendingMAC is the MAC that the header will have once the pending key
+	// rotation is committed, as the MAC covers KeyGeneration.
+	PendingMAC []byte `msgpack:"r"`
+	// FileSize is the size of the file plaintext. It is only used by headers
+	// without sealed data, see Private.
 	FileSize uint64 `msgpack:"s"`
 	// EncryptedSize is the size of the file ciphertext.
 	EncryptedSize uint64 `msgpack:"e"`
-	// CompressedSize is the size of the file after compression.
+	// CompressedSize is the size of the file after compression. It is only used
+	// by headers without sealed data, see Private.
 	CompressedSize uint64 `msgpack:"z"`
+	// DataShards is the number of data shards. It is zero in headers written
+	// before it was introduced.
+	DataShards int `msgpack:"d"`
+	// Trailer marks whether a copy of the complete header is kept at the end of
+	// the shard.
+	Trailer bool `msgpack:"t"`
+	// Footer marks that the header at the start of the shard is never
+	// finalized, and that the trailer is the authoritative header instead.
+	Footer bool `msgpack:"u"`
 	// RSBlockSize is the size of the Reed-Solomon block.
 	RSBlockSize int `msgpack:"b"`
 	// AESBlockSize is the size of the AES block.
 	AESBlockSize int `msgpack:"a"`
 	// IsComplete marks whether the header is complete.
 	IsComplete bool `msgpack:"o"`
+	// Sealed contains the Private fields, encrypted with the file key.
+	Sealed []byte `msgpack:"x"`
+	// MAC authenticates the fields required to decode the shard with a key
+	// derived from the file key. See ComputeMAC.
+	MAC []byte `msgpack:"y"`
+
+	// Version is the version of the header format. Zero means CurrentVersion.
+	Version int `msgpack:"-"`
+	// Size is the size allocated for the header. Zero means the default size of
+	// the header version.
+	Size int `msgpack:"-"`
+	// UnknownSections contains the sections that this version doesn't know
+	// about.
+	UnknownSections []Section `msgpack:"-"`
 }
 
-// HeaderSize is the fixed size allocated for the header.
-const HeaderSize = 512
+// Section is a section of a version 2 header.
+type Section struct {
+	Type uint16
+	Data []byte
+}
+
+const (
+	// HeaderSize is the fixed size allocated for a version 1 header.
+	//
+	// Deprecated: version 2 headers don't have a fixed size. Use
+	// Header.EncodedSize() instead.
+	HeaderSize = v1Size
+	// DefaultSize is the default size allocated for a version 2 header. The
+	// header is written before the data and rewritten in place once the data
+	// is encoded, when a key rotation stores its pending key split and MAC,
+	// and when the shards are migrated, so it is allocated up front with room
+	// for the largest header that any of these can produce. Without metadata,
+	// a complete header with every digest and a pending key rotation takes up
+	// about 530 bytes, which leaves about 3.5 KiB for the metadata, and keeps
+	// the start of the data aligned to the page size.
+	DefaultSize = 4096
+	// MaxSize is the largest header size that is accepted when reading.
+	MaxSize = 1 << 20
+
+	// CurrentVersion is the version of the header format that is written by
+	// default.
+	CurrentVersion = 2
+
+	// SectionCore is the type of the section that contains the Header fields.
+	SectionCore uint16 = 1
+
+	// v1Size is the fixed size allocated for a version 1 header.
+	v1Size = 512
+
+	// prefixSize is the size of the magic bytes, header size and sections
+	// length of a version 2 header.
+	prefixSize = 16
+	// sectionPrefixSize is the size of the type and length of a section.
+	sectionPrefixSize = 6
+)
+
+// checksumSize is the size of the checksum following the sections of a version
+// 2 header.
+const checksumSize = 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
 
 var (
-	MagicBytes = []byte("STITCHv1")
+	MagicBytes   = []byte("STITCHv1")
+	MagicBytesV2 = []byte("STITCHv2")
 
 	ErrInvalidHeaderSize = errors.New("invalid header size")
 	ErrUnrecognizedMagic = errors.New("unrecognized magic bytes")
 	ErrHeaderNotComplete = errors.New("header not complete")
+	ErrCorruptHeader     = errors.New("header is corrupted")
+	ErrMissingSection    = errors.New("header is missing a required section")
 )
 
 func NewHeader() *Header {
-	return &Header{}
+	return &Header{
+		Version: CurrentVersion,
+		Size:    DefaultSize,
+	}
 }
 
+// EncodedSize returns the size of the encoded header.
+func (h *Header) EncodedSize() int {
+	if h.Size != 0 {
+		return h.Size
+	}
+	if h.Version == 1 {
+		return v1Size
+	}
+	return DefaultSize
+}
+
+// Encode encodes the header in the format given by Version.
 func (h *Header) Encode() ([]byte, error) {
+	switch h.Version {
+	case 0, CurrentVersion:
+		return h.encodeV2()
+	case 1:
+		return h.encodeV1()
+	}
+	return nil, fmt.Errorf("unsupported header version %d", h.Version)
+}
+
+func (h *Header) encodeV2() ([]byte, error) {
+	size := h.EncodedSize()
+	if size < prefixSize+checksumSize || size > MaxSize {
+		return nil, ErrInvalidHeaderSize
+	}
+
+	// Marshal the header data as MsgPack.
+	core, err := msgpack.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lay out the sections, starting with the core section.
+	sections := append([]Section{{Type: SectionCore, Data: core}},
+		h.UnknownSections...)
+	payloadLen := 0
+	for _, section := range sections {
+		payloadLen += sectionPrefixSize + len(section.Data)
+	}
+
+	// Make sure the sections are not too large.
+	if payloadLen > size-prefixSize-checksumSize {
+		return nil, ErrInvalidHeaderSize
+	}
+
 	// Allocate a buffer for the header.
-	buf := make([]byte, HeaderSize)
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+
+	// Write the magic bytes, the header size and the length of the sections.
+	copy(buf[:8], MagicBytesV2)
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(size))
+	binary.LittleEndian.PutUint32(buf[12:16], uint32(payloadLen))
+
+	// Write the sections.
+	off := prefixSize
+	for _, section := range sections {
+		binary.LittleEndian.PutUint16(buf[off:off+2], section.Type)
+		binary.LittleEndian.PutUint32(buf[off+2:off+6], uint32(len(section.Data)))
+		off += sectionPrefixSize
+		off += copy(buf[off:], section.Data)
+	}
+
+	// Write the checksum of everything before it.
+	binary.LittleEndian.PutUint32(buf[off:off+checksumSize],
+		crc32.Checksum(buf[:off], crcTable))
+
+	return buf, nil
+}
+
+func (h *Header) encodeV1() ([]byte, error) {
+	// Version 1 headers have a fixed size, and can't store sections.
+	if (h.Size != 0 && h.Size != v1Size) || len(h.UnknownSections) > 0 {
+		return nil, ErrInvalidHeaderSize
+	}
+
+	// Allocate a buffer for the header.
+	buf := make([]byte, v1Size)
 	if _, err := rand.Read(buf); err != nil {
 		return nil, err
 	}
@@ -72,7 +279,7 @@ func (h *Header) Encode() ([]byte, error) {
 	}
 
 	// Make sure the header data is not too large.
-	if len(data) > HeaderSize-8 {
+	if len(data) > v1Size-10 {
 		return nil, ErrInvalidHeaderSize
 	}
 
@@ -85,22 +292,133 @@ func (h *Header) Encode() ([]byte, error) {
 	return buf, nil
 }
 
-// Decode implements the encoding.BinaryUnmarshaler interface.
+// Decode implements the encoding.BinaryUnmarshaler interface. Both version 1
+// and version 2 headers are supported. If a version 2 header doesn't pass its
+// checksum, ErrCorruptHeader is returned.
 func (h *Header) Decode(data []byte) error {
-	// Check the magic bytes.
-	for i, b := range MagicBytes {
-		if b != data[i] {
-			return ErrUnrecognizedMagic
+	if len(data) < 10 {
+		return ErrInvalidHeaderSize
+	}
+
+	switch {
+	case bytes.Equal(data[:8], MagicBytes):
+		return h.decodeV1(data)
+	case bytes.Equal(data[:8], MagicBytesV2):
+		return h.decodeV2(data)
+	}
+	return ErrUnrecognizedMagic
+}
+
+func (h *Header) decodeV2(data []byte) error {
+	if len(data) < prefixSize {
+		return ErrInvalidHeaderSize
+	}
+
+	// Check the size of the header and its sections.
+	size := int(binary.LittleEndian.Uint32(data[8:12]))
+	if size > len(data) || size < prefixSize+checksumSize {
+		return ErrInvalidHeaderSize
+	}
+	end := prefixSize + int(binary.LittleEndian.Uint32(data[12:16]))
+	if end < prefixSize || end > size-checksumSize {
+		return ErrCorruptHeader
+	}
+
+	// Verify the checksum.
+	checksum := binary.LittleEndian.Uint32(data[end : end+checksumSize])
+	if crc32.Checksum(data[:end], crcTable) != checksum {
+		return ErrCorruptHeader
+	}
+
+	// Split the sections.
+	var core []byte
+	var unknown []Section
+	for off := prefixSize; off < end; {
+		if end-off < sectionPrefixSize {
+			return ErrCorruptHeader
+		}
+		typ := binary.LittleEndian.Uint16(data[off : off+2])
+		length := int(binary.LittleEndian.Uint32(data[off+2 : off+6]))
+		off += sectionPrefixSize
+		if length > end-off {
+			return ErrCorruptHeader
+		}
+		sectionData := data[off : off+length]
+		off += length
+
+		if typ == SectionCore {
+			core = sectionData
+			continue
 		}
+		unknown = append(unknown, Section{
+			Type: typ,
+			Data: append([]byte(nil), sectionData...),
+		})
+	}
+	if core == nil {
+		return ErrMissingSection
+	}
+
+	// Unmarshal the header data.
+	if err := msgpack.Unmarshal(core, h); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptHeader, err)
 	}
+	h.Version = 2
+	h.Size = size
+	h.UnknownSections = unknown
 
+	return nil
+}
+
+func (h *Header) decodeV1(data []byte) error {
 	// Check the size of the header data.
-	dataLen := binary.LittleEndian.Uint16(data[8:10])
+	end := 10 + int(binary.LittleEndian.Uint16(data[8:10]))
+	if end > len(data) {
+		return ErrCorruptHeader
+	}
 
 	// Unmarshal the header data.
-	if err := msgpack.Unmarshal(data[10:10+dataLen], h); err != nil {
-		return err
+	if err := msgpack.Unmarshal(data[10:end], h); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptHeader, err)
 	}
+	h.Version = 1
+	h.Size = v1Size
+	h.UnknownSections = nil
 
 	return nil
 }
+
+// Read reads a header of any version and size from r, leaving r positioned
+// right after the header.
+func Read(r io.Reader) (*Header, error) {
+	// Read the prefix to find out the size of the header.
+	prefix := make([]byte, prefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+	var size int
+	switch {
+	case bytes.Equal(prefix[:8], MagicBytes):
+		size = v1Size
+	case bytes.Equal(prefix[:8], MagicBytesV2):
+		size = int(binary.LittleEndian.Uint32(prefix[8:12]))
+		if size < prefixSize+checksumSize || size > MaxSize {
+			return nil, ErrInvalidHeaderSize
+		}
+	default:
+		return nil, ErrUnrecognizedMagic
+	}
+
+	// Read the rest of the header.
+	buf := make([]byte, size)
+	copy(buf, prefix)
+	if _, err := io.ReadFull(r, buf[prefixSize:]); err != nil {
+		return nil, err
+	}
+
+	h := NewHeader()
+	if err := h.Decode(buf); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
@@ -1,9 +1,12 @@
 package header_test
 
 import (
+	"bytes"
+	"encoding/binary"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
 
 	"github.com/OhanaFS/stitch/header"
 	"github.com/OhanaFS/stitch/util/debug"
@@ -34,3 +37,230 @@ func TestMarshalUnmarshal(t *testing.T) {
 	assert.Nil(err)
 	assert.Equal(h, h2)
 }
+
+func TestSealPrivate(t *testing.T) {
+	assert := assert.New(t)
+
+	fileKey := []byte("11111111222222223333333344444444")
+	priv := &header.Private{
+		FileHash:       testHash,
+		FileSize:       12345,
+		CompressedSize: 6789,
+	}
+
+	h := header.NewHeader()
+	assert.NoError(h.SealPrivate(fileKey, priv))
+
+	// The private fields shouldn't appear in the encoded header.
+	b, err := h.Encode()
+	assert.NoError(err)
+	assert.NotContains(string(b), string(testHash))
+
+	h2 := header.NewHeader()
+	assert.NoError(h2.Decode(b))
+	assert.Zero(h2.FileSize)
+	opened, err := h2.OpenPrivate(fileKey)
+	assert.NoError(err)
+	assert.Equal(priv, opened)
+
+	// A different key shouldn't be able to open them.
+	_, err = h2.OpenPrivate([]byte("44444444333333332222222211111111"))
+	assert.ErrorIs(err, header.ErrInvalidSealedData)
+}
+
+func TestChecksum(t *testing.T) {
+	assert := assert.New(t)
+
+	h := header.NewHeader()
+	h.ShardIndex = 1
+	h.FileKey = testKey
+	h.EncryptedSize = 4096
+
+	b, err := h.Encode()
+	assert.NoError(err)
+
+	// Flip a bit in the header data.
+	b[20] ^= 0x01
+	assert.ErrorIs(header.NewHeader().Decode(b), header.ErrCorruptHeader)
+
+	// Corrupt the length of the header sections.
+	b[20] ^= 0x01
+	b[13] ^= 0x7f
+	assert.ErrorIs(header.NewHeader().Decode(b), header.ErrCorruptHeader)
+
+	// Corrupt the length of the header data of a version 1 header.
+	h.Version, h.Size = 1, 0
+	b, err = h.Encode()
+	assert.NoError(err)
+	b[9] ^= 0x7f
+	assert.ErrorIs(header.NewHeader().Decode(b), header.ErrCorruptHeader)
+}
+
+func TestVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	h := header.NewHeader()
+	h.ShardIndex = 1
+	h.FileKey = testKey
+	h.UnknownSections = []header.Section{{Type: 0x1234, Data: []byte("future")}}
+
+	// Version 2 headers have the default size, and keep unknown sections.
+	b, err := h.Encode()
+	assert.NoError(err)
+	assert.Len(b, header.DefaultSize)
+	h2, err := header.Read(bytes.NewReader(b))
+	assert.NoError(err)
+	assert.Equal(h, h2)
+
+	// Larger headers can be used for more capacity.
+	h.Size = 2 * header.DefaultSize
+	h.UnknownSections[0].Data = make([]byte, header.DefaultSize)
+	b, err = h.Encode()
+	assert.NoError(err)
+	assert.Len(b, 2*header.DefaultSize)
+	h2, err = header.Read(bytes.NewReader(b))
+	assert.NoError(err)
+	assert.Equal(h, h2)
+
+	// Headers that don't fit are rejected.
+	h.Size = header.DefaultSize
+	_, err = h.Encode()
+	assert.ErrorIs(err, header.ErrInvalidHeaderSize)
+
+	// Version 1 headers can still be read and written.
+	h = header.NewHeader()
+	h.Version = 1
+	h.Size = 0
+	h.ShardIndex = 1
+	h.FileKey = testKey
+	b, err = h.Encode()
+	assert.NoError(err)
+	assert.Len(b, 512)
+	assert.Equal(header.MagicBytes, b[:8])
+	h2, err = header.Read(bytes.NewReader(b))
+	assert.NoError(err)
+	assert.Equal(1, h2.Version)
+	assert.Equal(512, h2.EncodedSize())
+	assert.Equal(testKey, h2.FileKey)
+}
+
+// baselineHeader is a version 1 header as read before version 2 headers were
+// introduced.
+type baselineHeader struct {
+	ShardIndex     int    `msgpack:"i"`
+	ShardCount     int    `msgpack:"c"`
+	FileHash       []byte `msgpack:"h"`
+	FileKey        []byte `msgpack:"k"`
+	FileSize       uint64 `msgpack:"s"`
+	EncryptedSize  uint64 `msgpack:"e"`
+	CompressedSize uint64 `msgpack:"z"`
+	RSBlockSize    int    `msgpack:"b"`
+	AESBlockSize   int    `msgpack:"a"`
+	IsComplete     bool   `msgpack:"o"`
+}
+
+// decodeBaseline decodes a version 1 header the way it was decoded before
+// version 2 headers were introduced.
+func decodeBaseline(data []byte) (*baselineHeader, error) {
+	for i, b := range header.MagicBytes {
+		if b != data[i] {
+			return nil, header.ErrUnrecognizedMagic
+		}
+	}
+	dataLen := binary.LittleEndian.Uint16(data[8:10])
+	h := &baselineHeader{}
+	if err := msgpack.Unmarshal(data[10:10+dataLen], h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func TestBaselineCompatibility(t *testing.T) {
+	assert := assert.New(t)
+
+	// Version 1 headers written now, e.g. when the key of an old shard is
+	// rotated, should still be readable by older versions.
+	h := header.NewHeader()
+	h.Version, h.Size = 1, 0
+	h.ShardIndex = 1
+	h.ShardCount = 3
+	h.FileHash = testHash
+	h.FileKey = testKey
+	h.FileSize = 12345
+	h.EncryptedSize = 8192
+	h.CompressedSize = 6789
+	h.RSBlockSize = 4096
+	h.AESBlockSize = 1024
+	h.IsComplete = true
+	h.MAC = []byte("MAC MAC MAC MAC MAC MAC MAC MAC!")
+	b, err := h.Encode()
+	assert.NoError(err)
+
+	old, err := decodeBaseline(b)
+	assert.NoError(err)
+	assert.Equal(&baselineHeader{
+		ShardIndex:     1,
+		ShardCount:     3,
+		FileHash:       testHash,
+		FileKey:        testKey,
+		FileSize:       12345,
+		EncryptedSize:  8192,
+		CompressedSize: 6789,
+		RSBlockSize:    4096,
+		AESBlockSize:   1024,
+		IsComplete:     true,
+	}, old)
+}
+
+func TestMAC(t *testing.T) {
+	assert := assert.New(t)
+
+	fileKey := []byte("11111111222222223333333344444444")
+	h := header.NewHeader()
+	h.ShardIndex = 1
+	h.EncryptedSize = 4096
+	h.IsComplete = true
+	h.MAC = h.ComputeMAC(fileKey)
+	assert.NoError(h.VerifyMAC(fileKey, true))
+
+	// Changing a field should invalidate the MAC.
+	h.EncryptedSize = 8192
+	assert.ErrorIs(h.VerifyMAC(fileKey, true), header.ErrCorruptHeader)
+	h.EncryptedSize = 4096
+	h.KeyGeneration = 1
+	assert.ErrorIs(h.VerifyMAC(fileKey, true), header.ErrCorruptHeader)
+	h.KeyGeneration = 0
+	h.IsComplete = false
+	assert.ErrorIs(h.VerifyMAC(fileKey, true), header.ErrCorruptHeader)
+	h.IsComplete = true
+	for _, change := range []func(h *header.Header){
+		func(h *header.Header) { h.DataShards = 2 },
+		func(h *header.Header) { h.Trailer = true },
+		func(h *header.Header) { h.Footer = true },
+		func(h *header.Header) { h.Size = 2 * header.DefaultSize },
+	} {
+		changed := *h
+		change(&changed)
+		assert.ErrorIs(changed.VerifyMAC(fileKey, true), header.ErrCorruptHeader)
+	}
+
+	// Moving bytes from one field to the next should invalidate it too.
+	h.Sealed = []byte("sealed")
+	h.FileID = []byte("file-id")
+	h.MAC = h.ComputeMAC(fileKey)
+	h.Sealed = []byte("sealedf")
+	h.FileID = []byte("ile-id")
+	assert.ErrorIs(h.VerifyMAC(fileKey, true), header.ErrCorruptHeader)
+	h.Sealed = []byte("sealed")
+	h.FileID = []byte("file-id")
+	assert.NoError(h.VerifyMAC(fileKey, true))
+
+	// But the key shares are not covered.
+	h.FileKey = testKey
+	assert.NoError(h.VerifyMAC(fileKey, true))
+
+	// A header without a MAC is only accepted if it isn't required.
+	h.MAC = nil
+	assert.NoError(h.VerifyMAC(fileKey, false))
+	assert.ErrorIs(h.VerifyMAC(fileKey, true), header.ErrCorruptHeader)
+}
@@ -0,0 +1,75 @@
+package header
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// macKey derives the key used to authenticate headers from the file key.
+func macKey(fileKey []byte) []byte {
+	mac := hmac.New(sha256.New, fileKey)
+	mac.Write([]byte("stitch header mac"))
+	return mac.Sum(nil)
+}
+
+// ComputeMAC returns a MAC over the header fields that are required to decode
+// the shard, keyed with the file key. The key shares are not covered, so that
+// keys can be rotated without knowing the file key. The key generation is, so a
+// rotation that increments it has to store the resulting MAC in PendingMAC.
+//
+// Variable-length fields are prefixed with their length, so that bytes can't
+// be moved from one field to the next without changing the MAC.
+func (h *Header) ComputeMAC(fileKey []byte) []byte {
+	buf := make([]byte, 8)
+	mac := hmac.New(sha256.New, macKey(fileKey))
+	writeUint := func(v uint64) {
+		binary.LittleEndian.PutUint64(buf, v)
+		mac.Write(buf)
+	}
+	writeBool := func(v bool) {
+		if v {
+			writeUint(1)
+		} else {
+			writeUint(0)
+		}
+	}
+	writeBytes := func(b []byte) {
+		writeUint(uint64(len(b)))
+		mac.Write(b)
+	}
+
+	writeUint(uint64(h.EncodedSize()))
+	writeUint(uint64(h.ShardIndex))
+	writeUint(uint64(h.ShardCount))
+	writeUint(uint64(h.DataShards))
+	writeUint(h.EncryptedSize)
+	writeUint(uint64(h.RSBlockSize))
+	writeUint(uint64(h.AESBlockSize))
+	writeUint(uint64(h.KeyGeneration))
+	writeBool(h.IsComplete)
+	writeBool(h.Trailer)
+	writeBool(h.Footer)
+	writeBytes(h.Sealed)
+	writeBytes(h.FileID)
+	writeUint(h.FileGeneration)
+	return mac.Sum(nil)
+}
+
+// VerifyMAC checks the MAC of the header with the file key, and returns
+// ErrCorruptHeader if it doesn't match. Headers without a MAC are only accepted
+// if required is false, which should only be the case when none of the headers
+// of the same file have a MAC, as otherwise the MAC could simply be removed.
+func (h *Header) VerifyMAC(fileKey []byte, required bool) error {
+	if len(h.MAC) == 0 {
+		if required {
+			return fmt.Errorf("%w: missing MAC", ErrCorruptHeader)
+		}
+		return nil
+	}
+	if !hmac.Equal(h.MAC, h.ComputeMAC(fileKey)) {
+		return fmt.Errorf("%w: MAC mismatch", ErrCorruptHeader)
+	}
+	return nil
+}
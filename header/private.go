@@ -0,0 +1,118 @@
+package header
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Private contains the header fields that would reveal information about the
+// file plaintext. They are sealed with the file key and stored in the header's
+// Sealed field, so that they can only be read by someone who is able to
+// decrypt the file.
+type Private struct {
+	// FileHash is the SHA256 hash of the whole file plaintext.
+	FileHash []byte `msgpack:"h"`
+	// FileSize is the size of the file plaintext.
+	FileSize uint64 `msgpack:"s"`
+	// CompressedSize is the size of the file after compression.
+	CompressedSize uint64 `msgpack:"z"`
+	// Digests contains additional digests of the file plaintext, keyed by the
+	// name of their algorithm.
+	Digests map[string][]byte `msgpack:"d,omitempty"`
+	// Metadata describes the file, if it was supplied when encoding.
+	Metadata *Metadata `msgpack:"m,omitempty"`
+}
+
+// Metadata contains user-supplied information about the file. It is stored
+// along with the other private fields, so it is only readable by someone who is
+// able to decrypt the file.
+type Metadata struct {
+	// Name is the original name of the file.
+	Name string `msgpack:"n,omitempty"`
+	// ContentType is the MIME type of the file.
+	ContentType string `msgpack:"t,omitempty"`
+	// Mode contains the permission bits of the file.
+	Mode uint32 `msgpack:"p,omitempty"`
+	// ModTime is the modification time of the file.
+	ModTime time.Time `msgpack:"m,omitempty"`
+	// Extra contains arbitrary key/value pairs, such as extended attributes.
+	Extra map[string]string `msgpack:"x,omitempty"`
+}
+
+var (
+	ErrInvalidSealedData = errors.New("invalid sealed header data")
+)
+
+// newPrivateCipher returns the AEAD used to seal the private header fields.
+func newPrivateCipher(fileKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealPrivate encrypts the private fields with the file key, and stores the
+// result in the header.
+func (h *Header) SealPrivate(fileKey []byte, p *Private) error {
+	gcm, err := newPrivateCipher(fileKey)
+	if err != nil {
+		return err
+	}
+
+	// Marshal the private fields as MsgPack.
+	data, err := msgpack.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	// Encrypt the data with a random nonce, which is prepended to the result.
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	h.Sealed = gcm.Seal(nonce, nonce, data, nil)
+
+	return nil
+}
+
+// OpenPrivate decrypts the private fields stored in the header with the file
+// key. For headers that don't have any sealed data, the private fields are
+// taken from the plaintext header instead.
+func (h *Header) OpenPrivate(fileKey []byte) (*Private, error) {
+	if len(h.Sealed) == 0 {
+		return &Private{
+			FileHash:       h.FileHash,
+			FileSize:       h.FileSize,
+			CompressedSize: h.CompressedSize,
+		}, nil
+	}
+
+	gcm, err := newPrivateCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(h.Sealed) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, ErrInvalidSealedData
+	}
+
+	// Decrypt the data.
+	nonce, ciphertext := h.Sealed[:gcm.NonceSize()], h.Sealed[gcm.NonceSize():]
+	data, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrInvalidSealedData
+	}
+
+	// Unmarshal the private fields.
+	p := &Private{}
+	if err := msgpack.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
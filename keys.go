@@ -1,6 +1,8 @@
 package stitch
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"fmt"
 	"io"
 
@@ -13,75 +15,342 @@ import (
 // Sharing Scheme. The resulting key splits are then returned.
 //
 // The caller must then use the UpdateShardKey() function to update each shard's
-// header to use the new key splits.
+// header to use the new key splits. Since every shard receives a new key split,
+// this also repairs any corrupted key shares. Use RotateKeysWithCheck() to keep
+// the key check value that tells a wrong key apart from corrupted shares.
 func (e *Encoder) RotateKeys(shards []io.ReadSeeker,
 	previousKey, previousIv, newKey, newIv []byte) ([][]byte, error) {
+	_, _, keySplits, err := e.resplitFileKey(shards, previousKey, previousIv, newKey, newIv)
+	if err != nil {
+		return nil, err
+	}
+	return keySplits, nil
+}
+
+// RotateKeysWithCheck is like RotateKeys, but also returns the key check value
+// of the new key, to be stored along with the key splits using
+// UpdateShardKeyWithCheck().
+func (e *Encoder) RotateKeysWithCheck(shards []io.ReadSeeker,
+	previousKey, previousIv, newKey, newIv []byte) ([][]byte, []byte, error) {
+	_, fileID, keySplits, err := e.resplitFileKey(shards, previousKey, previousIv,
+		newKey, newIv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keySplits, keyCheckValue(newKey, newIv, fileID), nil
+}
+
+// resplitFileKey reconstructs the file key from the shards with the previous
+// key and iv, and splits it again with the new key and iv. It returns the file
+// key and the file ID along with the new key splits.
+func (e *Encoder) resplitFileKey(shards []io.ReadSeeker,
+	previousKey, previousIv, newKey, newIv []byte) ([]byte, []byte, [][]byte, error) {
 	totalShards := int(e.opts.DataShards + e.opts.ParityShards)
 
 	// Check if there are sufficient input shards
 	if len(shards) < int(e.opts.DataShards) {
-		return nil, ErrNotEnoughShards
+		return nil, nil, nil, ErrNotEnoughShards
 	}
 
 	// Try to read the shard headers.
-	_, headers, _, err := readHeader(shards, totalShards)
+	okIdx, headers, _, _, _, err := readHeader(shards, totalShards)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read header: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to read header: %w", err)
 	}
 
 	// Combine the header keys to get the encrypted file key.
-	fileKey, err := combineHeaderKeys(headers, previousKey, previousIv)
+	fileKey, _, err := combineHeaderKeys(headers, previousKey, previousIv,
+		int(e.opts.KeyThreshold))
 	if err != nil {
-		return nil, fmt.Errorf("failed to combine header keys: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to combine header keys: %w", err)
 	}
 
 	// Split the file key with the new key.
 	keySplits, err := splitFileKey(fileKey, newKey, newIv,
 		totalShards, int(e.opts.KeyThreshold))
 	if err != nil {
-		return nil, fmt.Errorf("failed to split file key: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to split file key: %v", err)
 	}
 
-	return keySplits, nil
+	return fileKey, headers[okIdx].FileID, keySplits, nil
 }
 
 // UpdateShardKey updates the header of the supplied shard with the new key
 // split. The header is then written to the shard. To obtain a new key split,
 // use the RotateKeys() function.
-func (*Encoder) UpdateShardKey(shard io.ReadWriteSeeker, newKeySplit []byte) error {
-	// Seek to the beginning of the shard.
-	if _, err := shard.Seek(0, io.SeekStart); err != nil {
-		return fmt.Errorf("failed to seek to beginning of shard: %v", err)
-	}
+//
+// The key check value of the previous key is cleared, as it would no longer
+// match. Use UpdateShardKeyWithCheck() to store the one of the new key instead.
+func (e *Encoder) UpdateShardKey(shard io.ReadWriteSeeker, newKeySplit []byte) error {
+	return e.UpdateShardKeyWithCheck(shard, newKeySplit, nil)
+}
 
+// UpdateShardKeyWithCheck is like UpdateShardKey, but also stores the key check
+// value of the new key, as returned by RotateKeysWithCheck().
+//
+// The headers are rewritten one shard at a time, so an interruption can leave
+// the shards wrapped under different keys. Use PrepareKeyRotation() and
+// CommitKeyRotation() for a rotation that can be resumed or rolled back. The key
+// generation is left unchanged, as it is covered by the header MAC, which can't
+// be recomputed without the file key.
+func (*Encoder) UpdateShardKeyWithCheck(shard io.ReadWriteSeeker,
+	newKeySplit, newKeyCheck []byte) error {
 	// Read the header.
-	buf := make([]byte, header.HeaderSize)
-	if _, err := shard.Read(buf); err != nil {
-		return fmt.Errorf("failed to read header: %v", err)
-	}
-
-	// Parse the header
-	hdr := header.NewHeader()
-	if err := hdr.Decode(buf); err != nil {
-		return fmt.Errorf("failed to decode header: %v", err)
+	hdr, err := readShardHeader(shard)
+	if err != nil {
+		return err
 	}
 
 	// Update the header with the new key split.
 	hdr.FileKey = newKeySplit
-	newHeader, err := hdr.Encode()
+	hdr.KeyCheck = newKeyCheck
+	hdr.PendingFileKey = nil
+	hdr.PendingKeyCheck = nil
+	hdr.PendingMAC = nil
+
+	// Write the new header.
+	return writeShardHeader(shard, hdr)
+}
+
+// PrepareKeyRotation is the first phase of a crash-safe key rotation. It
+// reconstructs the file key with the previous key and iv, splits it again with
+// the new key and iv, and stores the new key splits in each shard's header
+// alongside the current ones. The file can be decoded with either key until the
+// rotation is committed using CommitKeyRotation(), or discarded using
+// RollbackKeyRotation().
+//
+// PrepareKeyRotation can be called again with the same keys, e.g. after it was
+// interrupted. If every shard already has an intact pending key split for the
+// new key, they are left as they are, otherwise the pending key splits are
+// written again to every shard. If the shards contain a pending rotation to a
+// different key, or one that is being committed, ErrKeyRotationInProgress is
+// returned, and the pending rotation has to be committed or rolled back first.
+func (e *Encoder) PrepareKeyRotation(shards []io.ReadWriteSeeker,
+	previousKey, previousIv, newKey, newIv []byte) error {
+	totalShards := int(e.opts.DataShards + e.opts.ParityShards)
+
+	// Check if there are sufficient input shards
+	if len(shards) < int(e.opts.DataShards) {
+		return ErrNotEnoughShards
+	}
+
+	// Try to read the shard headers.
+	readers := make([]io.ReadSeeker, len(shards))
+	for i, shard := range shards {
+		readers[i] = shard
+	}
+	okIdx, headers, _, _, _, err := readHeader(readers, totalShards)
 	if err != nil {
-		return fmt.Errorf("failed to encode header: %v", err)
+		return fmt.Errorf("failed to read header: %w", err)
 	}
 
-	// Seek to the beginning of the shard.
-	if _, err := shard.Seek(0, io.SeekStart); err != nil {
-		return fmt.Errorf("failed to seek to beginning of shard: %v", err)
+	// Make sure there isn't another rotation going on. A rotation to the same
+	// key is resumed instead.
+	keyCheck := keyCheckValue(newKey, newIv, headers[okIdx].FileID)
+	minGen, maxGen := -1, -1
+	complete, pending := 0, 0
+	for _, h := range headers {
+		if !h.IsComplete {
+			continue
+		}
+		complete++
+		if len(h.PendingFileKey) > 0 {
+			if !hmac.Equal(h.PendingKeyCheck, keyCheck) {
+				return ErrKeyRotationInProgress
+			}
+			pending++
+		}
+		if minGen == -1 || int(h.KeyGeneration) < minGen {
+			minGen = int(h.KeyGeneration)
+		}
+		if int(h.KeyGeneration) > maxGen {
+			maxGen = int(h.KeyGeneration)
+		}
+	}
+	if minGen != maxGen {
+		return ErrKeyRotationInProgress
 	}
 
-	// Write the new header.
-	if _, err := shard.Write(newHeader); err != nil {
-		return fmt.Errorf("failed to write header: %v", err)
+	// Reconstruct the file key, and split it with the new key.
+	fileKey, _, keySplits, err := e.resplitFileKey(readers,
+		previousKey, previousIv, newKey, newIv)
+	if err != nil {
+		return err
+	}
+
+	// Reuse the pending key splits if every shard has one, and they combine
+	// into the file key without any of them being corrupted. A split that was
+	// only partly written is replaced, as shares of different splits can't be
+	// combined.
+	if pending == complete {
+		pendingKey, badShards, err := combineHeaderKeys(headers, newKey, newIv,
+			int(e.opts.KeyThreshold))
+		if err == nil && len(badShards) == 0 && hmac.Equal(pendingKey, fileKey) {
+			return nil
+		}
+	}
+
+	// Store the new key splits as pending in each header.
+	for i, shard := range shards {
+		hdr, err := readShardHeader(shard)
+		if err != nil {
+			// Skip unreadable shards, they won't be able to use the new key.
+			continue
+		}
+		if !hdr.IsComplete || hdr.ShardIndex >= totalShards {
+			continue
+		}
+		// Skip shards that belong to a different file.
+		if !bytes.Equal(hdr.FileID, headers[okIdx].FileID) {
+			continue
+		}
+		hdr.PendingFileKey = keySplits[hdr.ShardIndex]
+		hdr.PendingKeyCheck = keyCheck
+
+		// Committing the rotation increments the key generation, which is
+		// covered by the MAC, so the MAC it will need is computed now.
+		if len(hdr.MAC) > 0 {
+			committed := *hdr
+			committed.KeyGeneration++
+			hdr.PendingMAC = committed.ComputeMAC(fileKey)
+		}
+		if err := writeShardHeader(shard, hdr); err != nil {
+			return fmt.Errorf("failed to update shard %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// CommitKeyRotation is the second phase of a crash-safe key rotation. It
+// replaces the current key split in each shard's header with the pending one
+// stored by PrepareKeyRotation(), and increments the key generation. No key is
+// required to commit a rotation.
+//
+// CommitKeyRotation is idempotent. If it is interrupted, calling it again with
+// the same shards resumes the rotation, and in the meantime the file can be
+// decoded with the new key. If PrepareKeyRotation() didn't finish updating
+// every shard, ErrKeyRotationIncomplete is returned and nothing is changed.
+func (*Encoder) CommitKeyRotation(shards []io.ReadWriteSeeker) error {
+	hdrs := make([]*header.Header, len(shards))
+	for i, shard := range shards {
+		if hdr, err := readShardHeader(shard); err == nil && hdr.IsComplete {
+			hdrs[i] = hdr
+		}
+	}
+
+	// Find the generation that the rotation is moving to.
+	targetGen := uint32(0)
+	for _, hdr := range hdrs {
+		if hdr == nil {
+			continue
+		}
+		gen := hdr.KeyGeneration
+		if len(hdr.PendingFileKey) > 0 {
+			gen++
+		}
+		if gen > targetGen {
+			targetGen = gen
+		}
+	}
+
+	// Make sure every shard either has a pending key split or has already been
+	// committed, before changing anything.
+	for _, hdr := range hdrs {
+		if hdr == nil {
+			continue
+		}
+		if len(hdr.PendingFileKey) == 0 && hdr.KeyGeneration != targetGen {
+			return ErrKeyRotationIncomplete
+		}
+	}
+
+	// Promote the pending key splits.
+	for i, hdr := range hdrs {
+		if hdr == nil || len(hdr.PendingFileKey) == 0 {
+			continue
+		}
+		hdr.FileKey = hdr.PendingFileKey
+		hdr.KeyCheck = hdr.PendingKeyCheck
+		hdr.KeyGeneration++
+		if len(hdr.PendingMAC) > 0 {
+			hdr.MAC = hdr.PendingMAC
+		}
+		hdr.PendingFileKey = nil
+		hdr.PendingKeyCheck = nil
+		hdr.PendingMAC = nil
+		if err := writeShardHeader(shards[i], hdr); err != nil {
+			return fmt.Errorf("failed to update shard %d: %w", i, err)
+		}
 	}
 
 	return nil
 }
+
+// RollbackKeyRotation discards the pending key splits stored by
+// PrepareKeyRotation(), leaving the shards wrapped with the previous key. Once
+// CommitKeyRotation() has updated any of the shards, the rotation can no longer
+// be rolled back and ErrKeyRotationCommitted is returned.
+func (*Encoder) RollbackKeyRotation(shards []io.ReadWriteSeeker) error {
+	hdrs := make([]*header.Header, len(shards))
+	for i, shard := range shards {
+		if hdr, err := readShardHeader(shard); err == nil && hdr.IsComplete {
+			hdrs[i] = hdr
+		}
+	}
+
+	// Make sure none of the shards have been committed yet.
+	minGen := -1
+	for _, hdr := range hdrs {
+		if hdr == nil {
+			continue
+		}
+		if minGen == -1 || int(hdr.KeyGeneration) < minGen {
+			minGen = int(hdr.KeyGeneration)
+		}
+	}
+	for _, hdr := range hdrs {
+		if hdr != nil && int(hdr.KeyGeneration) > minGen {
+			return ErrKeyRotationCommitted
+		}
+	}
+
+	// Discard the pending key splits.
+	for i, hdr := range hdrs {
+		if hdr == nil || len(hdr.PendingFileKey) == 0 {
+			continue
+		}
+		hdr.PendingFileKey = nil
+		hdr.PendingKeyCheck = nil
+		hdr.PendingMAC = nil
+		if err := writeShardHeader(shards[i], hdr); err != nil {
+			return fmt.Errorf("failed to update shard %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// VerifyKeyShares reads the header from the supplied shards and tries to
+// reconstruct the file key with the supplied key and iv. It returns the shard
+// indices of any key shares that are corrupted. As long as enough shares are
+// intact, the file key can still be reconstructed, and RotateKeys() can be used
+// to replace the corrupted shares.
+func (e *Encoder) VerifyKeyShares(shards []io.ReadSeeker, key, iv []byte) ([]int, error) {
+	totalShards := int(e.opts.DataShards + e.opts.ParityShards)
+
+	// Try to read the shard headers.
+	_, headers, _, _, _, err := readHeader(shards, totalShards)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	// Combine the header keys, keeping track of the corrupted ones.
+	_, badShards, err := combineHeaderKeys(headers, key, iv,
+		int(e.opts.KeyThreshold))
+	if err != nil {
+		return nil, fmt.Errorf("failed to combine header keys: %w", err)
+	}
+
+	return badShards, nil
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/OhanaFS/stitch"
+	"github.com/OhanaFS/stitch/header"
 	"github.com/OhanaFS/stitch/util"
 	"github.com/stretchr/testify/assert"
 )
@@ -33,10 +34,13 @@ func TestRotateKeys(t *testing.T) {
 	key2 := []byte("11111111111111111111111111111111")
 	iv2 := []byte("111111111111")
 
-	// Encode the data.
-	_, err := encoder.Encode(
-		input, []io.Writer{out1, out2, out3}, key1, iv1,
-	)
+	// Encode the data, hiding the WriteAt method of the output files so that
+	// the headers are left incomplete.
+	_, err := encoder.Encode(input, []io.Writer{
+		struct{ io.Writer }{out1},
+		struct{ io.Writer }{out2},
+		struct{ io.Writer }{out3},
+	}, key1, iv1)
 	assert.NoError(err)
 
 	// Rotate the keys before headers are finalized.
@@ -69,4 +73,216 @@ func TestRotateKeys(t *testing.T) {
 		key2, iv2, key1, iv1,
 	)
 	assert.NoError(err)
+
+	// Without a key check value, the previous key can't be told apart from
+	// corrupted shares.
+	_, err = encoder.RotateKeys(
+		[]io.ReadSeeker{out1, out2, out3},
+		key1, iv1, key2, iv2,
+	)
+	assert.Error(err)
+	assert.NotErrorIs(err, stitch.ErrWrongKey)
+
+	// Rotate the keys again, keeping the key check value.
+	newKeySplits, newKeyCheck, err := encoder.RotateKeysWithCheck(
+		[]io.ReadSeeker{out1, out2, out3},
+		key2, iv2, key1, iv1,
+	)
+	assert.NoError(err)
+	assert.NoError(encoder.UpdateShardKeyWithCheck(out1, newKeySplits[0], newKeyCheck))
+	assert.NoError(encoder.UpdateShardKeyWithCheck(out2, newKeySplits[1], newKeyCheck))
+	assert.NoError(encoder.UpdateShardKeyWithCheck(out3, newKeySplits[2], newKeyCheck))
+
+	_, err = encoder.RotateKeys(
+		[]io.ReadSeeker{out1, out2, out3},
+		key1, iv1, key2, iv2,
+	)
+	assert.NoError(err)
+
+	// The previous key should now be reported as the wrong key.
+	_, err = encoder.RotateKeys(
+		[]io.ReadSeeker{out1, out2, out3},
+		key2, iv2, key1, iv1,
+	)
+	assert.ErrorIs(err, stitch.ErrWrongKey)
+}
+
+// corruptShardKey flips a bit in the key share stored in the shard's header.
+func corruptShardKey(t *testing.T, shard io.ReadWriteSeeker) {
+	_, err := shard.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	hdr, err := header.Read(shard)
+	assert.NoError(t, err)
+	hdr.FileKey[0] ^= 0x01
+	b, err := hdr.Encode()
+	assert.NoError(t, err)
+
+	_, err = shard.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	_, err = shard.Write(b)
+	assert.NoError(t, err)
+}
+
+func TestWrongKeyAndCorruptShares(t *testing.T) {
+	assert := assert.New(t)
+
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 2,
+		KeyThreshold: 2,
+	})
+
+	input := util.NewLimitReader(&util.ZeroReadSeeker{}, 1024)
+	shards := make([]*util.Membuf, 4)
+	writers := make([]io.Writer, 4)
+	readers := make([]io.ReadSeeker, 4)
+	for i := range shards {
+		shards[i] = util.NewMembuf()
+		writers[i] = shards[i]
+		readers[i] = shards[i]
+	}
+
+	key := []byte("00000000000000000000000000000000")
+	iv := []byte("000000000000")
+	wrongKey := []byte("11111111111111111111111111111111")
+
+	_, err := encoder.Encode(input, writers, key, iv)
+	assert.NoError(err)
+	for _, shard := range shards {
+		assert.NoError(encoder.FinalizeHeader(shard))
+	}
+
+	// A wrong key should be detected as such.
+	_, err = encoder.NewReadSeeker(readers, wrongKey, iv)
+	assert.ErrorIs(err, stitch.ErrWrongKey)
+
+	// A single corrupted share should be tolerated, and reported.
+	corruptShardKey(t, shards[0])
+	_, err = encoder.NewReadSeeker(readers, key, iv)
+	assert.NoError(err)
+	badShards, err := encoder.VerifyKeyShares(readers, key, iv)
+	assert.NoError(err)
+	assert.Equal([]int{0}, badShards)
+
+	// With only the threshold number of good shares left, the file key should
+	// still be recoverable.
+	corruptShardKey(t, shards[3])
+	badShards, err = encoder.VerifyKeyShares(readers, key, iv)
+	assert.NoError(err)
+	assert.Equal([]int{0, 3}, badShards)
+
+	// Enough corrupted shares should be reported as corruption.
+	corruptShardKey(t, shards[1])
+	_, err = encoder.NewReadSeeker(readers, key, iv)
+	assert.ErrorIs(err, stitch.ErrCorruptKeyShares)
+}
+
+func TestTransactionalKeyRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+	})
+
+	input := util.NewLimitReader(&util.ZeroReadSeeker{}, 1024)
+	out1 := util.NewMembuf()
+	out2 := util.NewMembuf()
+	out3 := util.NewMembuf()
+	readers := []io.ReadSeeker{out1, out2, out3}
+	shards := []io.ReadWriteSeeker{out1, out2, out3}
+
+	key1 := []byte("00000000000000000000000000000000")
+	iv1 := []byte("000000000000")
+	key2 := []byte("11111111111111111111111111111111")
+	iv2 := []byte("111111111111")
+
+	_, err := encoder.Encode(input, []io.Writer{out1, out2, out3}, key1, iv1)
+	assert.NoError(err)
+	for _, shard := range []*util.Membuf{out1, out2, out3} {
+		assert.NoError(encoder.FinalizeHeader(shard))
+	}
+
+	// Prepare the rotation. Both keys should work afterwards.
+	assert.NoError(encoder.PrepareKeyRotation(shards, key1, iv1, key2, iv2))
+	_, err = encoder.NewReadSeeker(readers, key1, iv1)
+	assert.NoError(err)
+	_, err = encoder.NewReadSeeker(readers, key2, iv2)
+	assert.NoError(err)
+
+	// Preparing the same rotation again should leave the pending key splits
+	// as they are.
+	before := string(out1.Bytes())
+	assert.NoError(encoder.PrepareKeyRotation(shards, key1, iv1, key2, iv2))
+	assert.Equal(before, string(out1.Bytes()))
+
+	// A rotation to another key can't be started before the first one is
+	// resolved.
+	key3 := []byte("22222222222222222222222222222222")
+	iv3 := []byte("222222222222")
+	assert.ErrorIs(encoder.PrepareKeyRotation(shards, key1, iv1, key3, iv3),
+		stitch.ErrKeyRotationInProgress)
+
+	// A rotation that was only prepared on some of the shards is completed by
+	// preparing it again.
+	assert.NoError(encoder.RollbackKeyRotation(shards[2:]))
+	assert.ErrorIs(encoder.CommitKeyRotation(shards), stitch.ErrKeyRotationIncomplete)
+	assert.NoError(encoder.PrepareKeyRotation(shards, key1, iv1, key2, iv2))
+	_, err = encoder.NewReadSeeker([]io.ReadSeeker{out1, out3}, key2, iv2)
+	assert.NoError(err)
+
+	// Roll back, and only the old key should work.
+	assert.NoError(encoder.RollbackKeyRotation(shards))
+	_, err = encoder.NewReadSeeker(readers, key2, iv2)
+	assert.ErrorIs(err, stitch.ErrWrongKey)
+
+	// Prepare again, and simulate an interrupted commit.
+	assert.NoError(encoder.PrepareKeyRotation(shards, key1, iv1, key2, iv2))
+	assert.NoError(encoder.CommitKeyRotation(shards[:1]))
+
+	// The new key should work, and the rotation can't be rolled back anymore.
+	_, err = encoder.NewReadSeeker(readers, key2, iv2)
+	assert.NoError(err)
+	assert.ErrorIs(encoder.RollbackKeyRotation(shards),
+		stitch.ErrKeyRotationCommitted)
+
+	// Resume the commit. Only the new key should work afterwards.
+	assert.NoError(encoder.CommitKeyRotation(shards))
+	assert.NoError(encoder.CommitKeyRotation(shards))
+	_, err = encoder.NewReadSeeker(readers, key2, iv2)
+	assert.NoError(err)
+	_, err = encoder.NewReadSeeker(readers, key1, iv1)
+	assert.ErrorIs(err, stitch.ErrWrongKey)
+}
+
+func TestKeyCheckPerFile(t *testing.T) {
+	assert := assert.New(t)
+
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+	})
+	key := []byte("00000000000000000000000000000000")
+	iv := []byte("000000000000")
+
+	// Files wrapped with the same key shouldn't share a key check value.
+	var keyChecks [][]byte
+	for i := 0; i < 2; i++ {
+		out := util.NewMembuf()
+		input := util.NewLimitReader(&util.ZeroReadSeeker{}, 1024)
+		_, err := encoder.Encode(input,
+			[]io.Writer{out, util.NewMembuf(), util.NewMembuf()}, key, iv)
+		assert.NoError(err)
+		assert.NoError(encoder.FinalizeHeader(out))
+
+		_, err = out.Seek(0, io.SeekStart)
+		assert.NoError(err)
+		hdr, err := header.Read(out)
+		assert.NoError(err)
+		assert.NotEmpty(hdr.KeyCheck)
+		keyChecks = append(keyChecks, hdr.KeyCheck)
+	}
+	assert.NotEqual(keyChecks[0], keyChecks[1])
 }
@@ -0,0 +1,171 @@
+package keyshare
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/shamir"
+)
+
+// A key share is encoded as follows, followed by a checksum of the preceding
+// bytes:
+//
+// | Description                      | Length |
+// | -------------------------------- | ------ |
+// | version                          | 1      |
+// | threshold                        | 1      |
+// | fingerprint of the master key    | 4      |
+// | Shamir share of the master key   | -      |
+// | checksum                         | 4      |
+const (
+	shareVersion    = 1
+	fingerprintSize = 4
+	checksumSize    = 4
+	shareOverhead   = 2 + fingerprintSize + checksumSize
+)
+
+var (
+	ErrInvalidKeyShare     = errors.New("invalid key share")
+	ErrKeyShareChecksum    = errors.New("key share checksum mismatch")
+	ErrUnknownWord         = errors.New("unknown word in key share")
+	ErrFingerprintMismatch = errors.New("recombined key does not match its fingerprint")
+)
+
+// Share is a single share of a master key split among custodians.
+type Share struct {
+	Threshold   int
+	Fingerprint []byte
+	Data        []byte
+}
+
+// Fingerprint returns a short fingerprint of the master key, used to verify
+// the key after the shares are combined.
+func Fingerprint(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:fingerprintSize]
+}
+
+// Split splits the master key into n shares, any threshold of which can be
+// combined to recover it.
+func Split(key []byte, n, threshold int) ([]*Share, error) {
+	parts, err := shamir.Split(key, n, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := Fingerprint(key)
+	shares := make([]*Share, len(parts))
+	for i, part := range parts {
+		shares[i] = &Share{
+			Threshold:   threshold,
+			Fingerprint: fingerprint,
+			Data:        part,
+		}
+	}
+	return shares, nil
+}
+
+// Combine recovers the master key from the shares, and verifies it against the
+// fingerprint stored in the shares.
+func Combine(shares []*Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, ErrInvalidKeyShare
+	}
+	parts := make([][]byte, len(shares))
+	for i, share := range shares {
+		parts[i] = share.Data
+	}
+	key, err := shamir.Combine(parts)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(Fingerprint(key), shares[0].Fingerprint) {
+		return nil, ErrFingerprintMismatch
+	}
+	return key, nil
+}
+
+// Bytes returns the binary representation of the key share.
+func (s *Share) Bytes() []byte {
+	b := []byte{shareVersion, byte(s.Threshold)}
+	b = append(b, s.Fingerprint...)
+	b = append(b, s.Data...)
+	sum := sha256.Sum256(b)
+	return append(b, sum[:checksumSize]...)
+}
+
+// Parse parses the binary representation of a key share and verifies its
+// checksum.
+func Parse(b []byte) (*Share, error) {
+	if len(b) <= shareOverhead || b[0] != shareVersion {
+		return nil, ErrInvalidKeyShare
+	}
+
+	// Verify the checksum
+	data, checksum := b[:len(b)-checksumSize], b[len(b)-checksumSize:]
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(checksum, sum[:checksumSize]) {
+		return nil, ErrKeyShareChecksum
+	}
+
+	return &Share{
+		Threshold:   int(data[1]),
+		Fingerprint: data[2 : 2+fingerprintSize],
+		Data:        data[2+fingerprintSize:],
+	}, nil
+}
+
+// Encode encodes the key share as text, either as "hex" or as "words".
+func Encode(s *Share, format string) (string, error) {
+	b := s.Bytes()
+	switch format {
+	case "hex":
+		return hex.EncodeToString(b), nil
+	case "words":
+		words := make([]string, len(b))
+		for i, c := range b {
+			words[i] = wordList[c]
+		}
+		return strings.Join(words, " "), nil
+	}
+	return "", fmt.Errorf("unknown format '%s'", format)
+}
+
+// Decode decodes a key share from text. The format is detected automatically.
+// Words may be abbreviated to their first four letters.
+func Decode(text string) (*Share, error) {
+	fields := strings.Fields(strings.ToLower(text))
+	if len(fields) == 0 {
+		return nil, ErrInvalidKeyShare
+	}
+
+	// A single field is a hex-encoded share
+	if len(fields) == 1 {
+		b, err := hex.DecodeString(fields[0])
+		if err != nil {
+			return nil, ErrInvalidKeyShare
+		}
+		return Parse(b)
+	}
+
+	// Otherwise, each field is a word
+	b := make([]byte, len(fields))
+	for i, field := range fields {
+		found := false
+		for j, word := range wordList {
+			if field == word || (len(field) >= 4 && strings.HasPrefix(word, field)) {
+				b[i] = byte(j)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: '%s'", ErrUnknownWord, field)
+		}
+	}
+	return Parse(b)
+}
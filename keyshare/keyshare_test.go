@@ -0,0 +1,106 @@
+package keyshare_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/OhanaFS/stitch/keyshare"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	key := []byte("11111111222222223333333344444444")
+	shares, err := keyshare.Split(key, 5, 3)
+	assert.NoError(err)
+	assert.Len(shares, 5)
+
+	for _, format := range []string{"hex", "words"} {
+		decoded := make([]*keyshare.Share, len(shares))
+		for i, share := range shares {
+			text, err := keyshare.Encode(share, format)
+			assert.NoError(err)
+			decoded[i], err = keyshare.Decode(text)
+			assert.NoError(err)
+			assert.Equal(share, decoded[i])
+		}
+
+		// Any 3 of the shares should recombine the key.
+		combined, err := keyshare.Combine(decoded[2:])
+		assert.NoError(err)
+		assert.Equal(key, combined)
+		combined, err = keyshare.Combine([]*keyshare.Share{decoded[4], decoded[0], decoded[3]})
+		assert.NoError(err)
+		assert.Equal(key, combined)
+	}
+
+	// Words can be abbreviated and are case-insensitive.
+	text, err := keyshare.Encode(shares[0], "words")
+	assert.NoError(err)
+	words := strings.Fields(text)
+	for i, word := range words {
+		if len(word) > 4 {
+			words[i] = strings.ToUpper(word[:4])
+		}
+	}
+	share, err := keyshare.Decode(strings.Join(words, " "))
+	assert.NoError(err)
+	assert.Equal(shares[0], share)
+
+	_, err = keyshare.Encode(shares[0], "base64")
+	assert.Error(err)
+}
+
+func TestChecksum(t *testing.T) {
+	assert := assert.New(t)
+
+	key := []byte("11111111222222223333333344444444")
+	shares, err := keyshare.Split(key, 3, 2)
+	assert.NoError(err)
+
+	// A mistyped byte should fail the checksum.
+	b := shares[0].Bytes()
+	for i := range b[1:] {
+		corrupted := append([]byte{}, b...)
+		corrupted[1+i] ^= 0x01
+		_, err = keyshare.Parse(corrupted)
+		assert.ErrorIs(err, keyshare.ErrKeyShareChecksum)
+	}
+
+	// So should two swapped words.
+	text, err := keyshare.Encode(shares[0], "words")
+	assert.NoError(err)
+	words := strings.Fields(text)
+	i := 2
+	for words[i] == words[i+1] {
+		i++
+	}
+	words[i], words[i+1] = words[i+1], words[i]
+	_, err = keyshare.Decode(strings.Join(words, " "))
+	assert.ErrorIs(err, keyshare.ErrKeyShareChecksum)
+
+	// Words that aren't in the list, or are too short to tell apart, are
+	// rejected.
+	words = strings.Fields(text)
+	words[5] = "xyzzy"
+	_, err = keyshare.Decode(strings.Join(words, " "))
+	assert.ErrorIs(err, keyshare.ErrUnknownWord)
+	words[5] = "ab"
+	_, err = keyshare.Decode(strings.Join(words, " "))
+	assert.ErrorIs(err, keyshare.ErrUnknownWord)
+
+	// Truncated shares are invalid.
+	_, err = keyshare.Parse(b[:6])
+	assert.ErrorIs(err, keyshare.ErrInvalidKeyShare)
+	_, err = keyshare.Decode("not-hex")
+	assert.ErrorIs(err, keyshare.ErrInvalidKeyShare)
+
+	// A share that was corrupted without going through the checksum leads to a
+	// key that doesn't match the fingerprint.
+	corrupted := *shares[1]
+	corrupted.Data = append([]byte{}, shares[1].Data...)
+	corrupted.Data[0] ^= 0x01
+	_, err = keyshare.Combine([]*keyshare.Share{shares[0], &corrupted})
+	assert.ErrorIs(err, keyshare.ErrFingerprintMismatch)
+}
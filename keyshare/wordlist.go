@@ -0,0 +1,38 @@
+package keyshare
+
+// wordList maps each byte value to a word when encoding key shares as words.
+// Every word has a unique four-letter prefix, so words can be abbreviated.
+var wordList = [256]string{
+	"able", "acid", "acorn", "actor", "adult", "agent", "alarm", "alley",
+	"amber", "angle", "apple", "april", "arena", "arrow", "aspen", "atlas",
+	"audit", "avocado", "award", "bacon", "bagel", "baker", "bamboo", "banjo",
+	"barrel", "basil", "beach", "beaver", "bench", "berry", "bishop", "blanket",
+	"blossom", "border", "bottle", "boxer", "breeze", "brick", "bridge", "bucket",
+	"buffalo", "bunny", "butter", "cactus", "camel", "candle", "canvas", "carbon",
+	"carpet", "cattle", "cello", "cement", "cherry", "chimney", "cider", "circus",
+	"clover", "cobalt", "coconut", "comet", "copper", "coral", "coyote", "cradle",
+	"crater", "crystal", "cupboard", "daisy", "dancer", "decade", "deputy", "desert",
+	"dinner", "dolphin", "donkey", "drawer", "dune", "eagle", "easel", "echo",
+	"eclipse", "elbow", "ember", "emerald", "engine", "equator", "escape", "estate",
+	"exotic", "fabric", "falcon", "fancy", "feather", "fence", "fiddle", "figure",
+	"finch", "flame", "florist", "fluid", "forest", "fox", "frost", "fruit",
+	"galaxy", "garden", "garlic", "gecko", "genius", "giant", "ginger", "globe",
+	"goblet", "gopher", "gospel", "gravel", "grocery", "gutter", "habit", "hammer",
+	"harvest", "hazel", "helmet", "heron", "honey", "horizon", "hotel", "hybrid",
+	"icicle", "igloo", "indigo", "infant", "insect", "ivory", "jacket", "jaguar",
+	"jasmine", "jigsaw", "jockey", "journal", "juniper", "kayak", "kernel", "kidney",
+	"kitten", "knight", "ladder", "lagoon", "lantern", "laptop", "lemon", "leopard",
+	"lettuce", "lilac", "linen", "lizard", "locket", "lotus", "lumber", "magnet",
+	"mango", "maple", "marble", "melon", "mercury", "metal", "mitten", "monkey",
+	"mosaic", "muffin", "museum", "mustard", "nectar", "needle", "nephew", "noodle",
+	"novel", "nugget", "nutmeg", "ocean", "octopus", "olive", "opera", "orange",
+	"orbit", "otter", "oven", "oyster", "palace", "panda", "paper", "parrot",
+	"pencil", "pepper", "piano", "pilot", "pirate", "planet", "pocket", "pony",
+	"potato", "pulsar", "puzzle", "quartz", "quiver", "radar", "radish", "raisin",
+	"raven", "recipe", "ribbon", "rodeo", "rooster", "ruby", "salmon", "sandal",
+	"satin", "scarf", "shovel", "silver", "skater", "socket", "sofa", "spider",
+	"squid", "statue", "table", "tango", "teapot", "tennis", "thistle", "ticket",
+	"tiger", "timber", "tomato", "tractor", "trumpet", "tunnel", "turtle", "tuxedo",
+	"unicorn", "uranium", "utopia", "valley", "velvet", "violin", "vortex", "wagon",
+	"walnut", "walrus", "whale", "wizard", "yacht", "zebra", "zenith", "zipper",
+}
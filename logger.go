@@ -0,0 +1,29 @@
+package stitch
+
+// Logger receives events from the encoder, such as missing or corrupted shards.
+// Each method takes a message followed by alternating keys and values, the same
+// as the methods of *slog.Logger, which satisfies this interface. It may be
+// called from multiple goroutines.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// nopLogger discards every event. It is used when no Logger is supplied.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// logger returns the Logger from the options, or one that discards every event
+// if there isn't one.
+func (e *Encoder) logger() Logger {
+	if e.opts.Logger == nil {
+		return nopLogger{}
+	}
+	return e.opts.Logger
+}
@@ -0,0 +1,100 @@
+package stitch_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/OhanaFS/stitch"
+	"github.com/OhanaFS/stitch/header"
+	"github.com/OhanaFS/stitch/reedsolomon"
+	"github.com/OhanaFS/stitch/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// testLogger records the events logged to it.
+type testLogger struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *testLogger) log(level, msg string, args []any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, fmt.Sprint(append([]any{level, msg}, args...)...))
+}
+
+func (l *testLogger) Debug(msg string, args ...any) { l.log("DEBUG", msg, args) }
+func (l *testLogger) Info(msg string, args ...any)  { l.log("INFO", msg, args) }
+func (l *testLogger) Warn(msg string, args ...any)  { l.log("WARN", msg, args) }
+func (l *testLogger) Error(msg string, args ...any) { l.log("ERROR", msg, args) }
+
+func TestLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	input := make([]byte, 50000)
+	_, err := rand.Read(input)
+	assert.NoError(err)
+
+	logger := &testLogger{}
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+		Logger:       logger,
+	})
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	shards := make([]*util.Membuf, 3)
+	shardWriters := make([]io.Writer, 3)
+	for i := range shards {
+		shards[i] = util.NewMembuf()
+		shardWriters[i] = shards[i]
+	}
+	_, err = encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+	assert.NoError(err)
+
+	// Corrupt the second block of the first shard.
+	offset := header.DefaultSize + 4096 + reedsolomon.BlockOverhead + 10
+	shards[0].Bytes()[offset] ^= 0xff
+
+	reader, err := encoder.NewReadSeeker(
+		[]io.ReadSeeker{shards[0], shards[1], shards[2]}, key, iv)
+	assert.NoError(err)
+	output, err := io.ReadAll(reader)
+	assert.NoError(err)
+	assert.Equal(input, output)
+	assert.Contains(logger.events, fmt.Sprint("WARN", "corrected corrupt block",
+		"shard", 0, "block", 1))
+
+	// Reading the block again after seeking back shouldn't report it again.
+	_, err = reader.Seek(0, io.SeekStart)
+	assert.NoError(err)
+	output, err = io.ReadAll(reader)
+	assert.NoError(err)
+	assert.Equal(input, output)
+	reports := 0
+	for _, event := range logger.events {
+		if strings.Contains(event, "corrected corrupt block") {
+			reports++
+		}
+	}
+	assert.Equal(1, reports)
+
+	// Repair the block, and leave out a shard instead.
+	shards[0].Bytes()[offset] ^= 0xff
+	logger.events = nil
+	reader, err = encoder.NewReadSeeker(
+		[]io.ReadSeeker{shards[1], shards[0]}, key, iv)
+	assert.NoError(err)
+	output, err = io.ReadAll(reader)
+	assert.NoError(err)
+	assert.Equal(input, output)
+	assert.Equal([]string{fmt.Sprint("WARN", "missing shard", "shard", 2)},
+		logger.events)
+}
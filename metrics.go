@@ -0,0 +1,109 @@
+package stitch
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Names of the metrics reported to Metrics. Every metric is labelled with the
+// operation that reported it, or with the stage of the encoding pipeline for
+// MetricStageDuration.
+const (
+	// MetricBytesIn is a counter of the bytes read by a stage. This is the
+	// plaintext when encoding, the encrypted data when decoding, rekeying and
+	// salvaging, and the shards when verifying.
+	MetricBytesIn = "stitch_bytes_in_total"
+	// MetricBytesOut is a counter of the bytes written by a stage. This is the
+	// shards when encoding and rekeying, and the plaintext when decoding and
+	// salvaging.
+	MetricBytesOut = "stitch_bytes_out_total"
+	// MetricCompressionRatio is a histogram of the ratio between the size of
+	// the plaintext and the size of the compressed data of encoded files.
+	MetricCompressionRatio = "stitch_compression_ratio"
+	// MetricCorruptBlocks is a counter of the corrupted shard blocks that were
+	// found when decoding or verifying. When decoding, each block is counted
+	// once per reader, even if it is read again after seeking.
+	MetricCorruptBlocks = "stitch_corrupt_blocks_total"
+	// MetricIrrecoverableBlocks is a counter of the blocks that were found to
+	// have too few healthy shards to be recovered when verifying.
+	MetricIrrecoverableBlocks = "stitch_irrecoverable_blocks_total"
+	// MetricStageDuration is a histogram of the time taken by an operation, in
+	// seconds. Encode() also reports the time spent in each stage of the
+	// encoding pipeline, from StageRead to StageWrite, as in StageTimings.
+	MetricStageDuration = "stitch_stage_duration_seconds"
+)
+
+// Metrics receives measurements from the encoder. The metrics package contains
+// an implementation that exposes them in the Prometheus text format. It must be
+// safe for concurrent use.
+type Metrics interface {
+	// AddCounter adds value to a counter.
+	AddCounter(name string, stage Stage, value float64)
+	// ObserveHistogram records a value in a histogram.
+	ObserveHistogram(name string, stage Stage, value float64)
+}
+
+// nopMetrics discards every measurement. It is used when no Metrics is
+// supplied.
+type nopMetrics struct{}
+
+func (nopMetrics) AddCounter(string, Stage, float64)       {}
+func (nopMetrics) ObserveHistogram(string, Stage, float64) {}
+
+// metrics returns the Metrics from the options, or one that discards every
+// measurement if there isn't one.
+func (e *Encoder) metrics() Metrics {
+	if e.opts.Metrics == nil {
+		return nopMetrics{}
+	}
+	return e.opts.Metrics
+}
+
+// recordStage reports the bytes read and written by a stage, and the time it
+// took since start.
+func (e *Encoder) recordStage(stage Stage, start time.Time, in, out int64) {
+	m := e.metrics()
+	m.AddCounter(MetricBytesIn, stage, float64(in))
+	m.AddCounter(MetricBytesOut, stage, float64(out))
+	m.ObserveHistogram(MetricStageDuration, stage, time.Since(start).Seconds())
+}
+
+// recordTimings reports the time spent in each stage of the encoding pipeline.
+func (e *Encoder) recordTimings(timings StageTimings) {
+	m := e.metrics()
+	for stage, d := range map[Stage]time.Duration{
+		StageRead:        timings.Read,
+		StageHash:        timings.Hash,
+		StageCompress:    timings.Compress,
+		StageEncrypt:     timings.Encrypt,
+		StageErasureCode: timings.ErasureCode,
+		StageWrite:       timings.Write,
+	} {
+		m.ObserveHistogram(MetricStageDuration, stage, d.Seconds())
+	}
+}
+
+// countingReadSeeker counts the bytes read from the underlying reader.
+type countingReadSeeker struct {
+	io.ReadSeeker
+	n *int64
+}
+
+func (r countingReadSeeker) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	io.Reader
+	n *int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,200 @@
+// Package metrics collects the measurements reported by a stitch.Encoder, and
+// exposes them over HTTP in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/OhanaFS/stitch"
+)
+
+// DefaultBuckets are the upper bounds of the buckets of histograms that don't
+// have any set in Registry.Buckets.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// help contains the descriptions of the metrics reported by stitch.
+var help = map[string]string{
+	stitch.MetricBytesIn:             "Bytes read by each stage.",
+	stitch.MetricBytesOut:            "Bytes written by each stage.",
+	stitch.MetricCompressionRatio:    "Ratio between the plaintext and compressed size of encoded files.",
+	stitch.MetricCorruptBlocks:       "Corrupted shard blocks found when decoding or verifying.",
+	stitch.MetricIrrecoverableBlocks: "Blocks found to be irrecoverable when verifying.",
+	stitch.MetricStageDuration:       "Time taken by each operation and encoding pipeline stage, in seconds.",
+}
+
+// histogram holds the observations of a histogram for a single stage.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Registry implements the stitch.Metrics interface, and keeps the measurements
+// in memory. It is safe for concurrent use.
+type Registry struct {
+	// Buckets contains the upper bounds of the buckets of each histogram, by
+	// name. It must not be changed after the registry is in use.
+	Buckets map[string][]float64
+
+	mu         sync.Mutex
+	counters   map[string]map[stitch.Stage]float64
+	histograms map[string]map[stitch.Stage]*histogram
+}
+
+// Assert that the Registry struct satisfies the stitch.Metrics and http.Handler
+// interfaces.
+var _ stitch.Metrics = &Registry{}
+var _ http.Handler = &Registry{}
+
+// NewRegistry creates a new Registry, with buckets suited to the histograms
+// reported by stitch.
+func NewRegistry() *Registry {
+	return &Registry{
+		Buckets: map[string][]float64{
+			stitch.MetricCompressionRatio: {1, 1.1, 1.25, 1.5, 2, 3, 5, 10},
+			stitch.MetricStageDuration:    {.01, .05, .1, .5, 1, 5, 10, 30, 60, 300},
+		},
+		counters:   make(map[string]map[stitch.Stage]float64),
+		histograms: make(map[string]map[stitch.Stage]*histogram),
+	}
+}
+
+// buckets returns the upper bounds of the buckets of a histogram.
+func (r *Registry) buckets(name string) []float64 {
+	if b, ok := r.Buckets[name]; ok {
+		return b
+	}
+	return DefaultBuckets
+}
+
+// AddCounter implements stitch.Metrics.
+func (r *Registry) AddCounter(name string, stage stitch.Stage, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.counters[name] == nil {
+		r.counters[name] = make(map[stitch.Stage]float64)
+	}
+	r.counters[name][stage] += value
+}
+
+// ObserveHistogram implements stitch.Metrics.
+func (r *Registry) ObserveHistogram(name string, stage stitch.Stage, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.histograms[name] == nil {
+		r.histograms[name] = make(map[stitch.Stage]*histogram)
+	}
+	buckets := r.buckets(name)
+	h := r.histograms[name][stage]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(buckets))}
+		r.histograms[name][stage] = h
+	}
+	for i, upper := range buckets {
+		if value <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// WriteTo writes the metrics to w in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	for _, name := range sortedKeys(r.counters) {
+		writeHeader(cw, name, "counter")
+		stages := r.counters[name]
+		for _, stage := range sortedStages(stages) {
+			fmt.Fprintf(cw, "%s{stage=%q} %s\n", name, stage, formatFloat(stages[stage]))
+		}
+	}
+	for _, name := range sortedKeys(r.histograms) {
+		writeHeader(cw, name, "histogram")
+		buckets := r.buckets(name)
+		stages := r.histograms[name]
+		for _, stage := range sortedStages(stages) {
+			h := stages[stage]
+			for i, upper := range buckets {
+				fmt.Fprintf(cw, "%s_bucket{stage=%q,le=%q} %d\n",
+					name, stage, formatFloat(upper), h.counts[i])
+			}
+			fmt.Fprintf(cw, "%s_bucket{stage=%q,le=\"+Inf\"} %d\n", name, stage, h.count)
+			fmt.Fprintf(cw, "%s_sum{stage=%q} %s\n", name, stage, formatFloat(h.sum))
+			fmt.Fprintf(cw, "%s_count{stage=%q} %d\n", name, stage, h.count)
+		}
+	}
+	return cw.n, cw.err
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = r.WriteTo(w)
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric.
+func writeHeader(w io.Writer, name, kind string) {
+	if h, ok := help[name]; ok {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, h)
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// formatFloat formats a value the way Prometheus expects.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedStages[V any](m map[stitch.Stage]V) []stitch.Stage {
+	stages := make([]stitch.Stage, 0, len(m))
+	for s := range m {
+		stages = append(stages, s)
+	}
+	sort.Slice(stages, func(i, j int) bool { return stages[i] < stages[j] })
+	return stages
+}
+
+// countingWriter counts the bytes written to the underlying writer, and keeps
+// the first error.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
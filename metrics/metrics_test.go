@@ -0,0 +1,105 @@
+package metrics_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/OhanaFS/stitch"
+	"github.com/OhanaFS/stitch/metrics"
+	"github.com/OhanaFS/stitch/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := metrics.NewRegistry()
+	registry.AddCounter(stitch.MetricBytesIn, stitch.StageEncode, 100)
+	registry.AddCounter(stitch.MetricBytesIn, stitch.StageEncode, 50)
+	registry.ObserveHistogram(stitch.MetricCompressionRatio, stitch.StageEncode, 1.5)
+	registry.ObserveHistogram(stitch.MetricCompressionRatio, stitch.StageEncode, 4)
+
+	buf := &bytes.Buffer{}
+	_, err := registry.WriteTo(buf)
+	assert.NoError(err)
+	assert.Equal(`# HELP stitch_bytes_in_total Bytes read by each stage.
+# TYPE stitch_bytes_in_total counter
+stitch_bytes_in_total{stage="encode"} 150
+# HELP stitch_compression_ratio Ratio between the plaintext and compressed size of encoded files.
+# TYPE stitch_compression_ratio histogram
+stitch_compression_ratio_bucket{stage="encode",le="1"} 0
+stitch_compression_ratio_bucket{stage="encode",le="1.1"} 0
+stitch_compression_ratio_bucket{stage="encode",le="1.25"} 0
+stitch_compression_ratio_bucket{stage="encode",le="1.5"} 1
+stitch_compression_ratio_bucket{stage="encode",le="2"} 1
+stitch_compression_ratio_bucket{stage="encode",le="3"} 1
+stitch_compression_ratio_bucket{stage="encode",le="5"} 2
+stitch_compression_ratio_bucket{stage="encode",le="10"} 2
+stitch_compression_ratio_bucket{stage="encode",le="+Inf"} 2
+stitch_compression_ratio_sum{stage="encode"} 5.5
+stitch_compression_ratio_count{stage="encode"} 2
+`, buf.String())
+}
+
+func TestEncoderMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := metrics.NewRegistry()
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+		Metrics:      registry,
+	})
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	input := make([]byte, 20000)
+	_, err := rand.Read(input)
+	assert.NoError(err)
+
+	shards := make([]*util.Membuf, 3)
+	shardWriters := make([]io.Writer, 3)
+	shardReaders := make([]io.ReadSeeker, 3)
+	for i := range shards {
+		shards[i] = util.NewMembuf()
+		shardWriters[i] = shards[i]
+		shardReaders[i] = shards[i]
+	}
+	_, err = encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+	assert.NoError(err)
+
+	reader, err := encoder.NewReadSeeker(shardReaders, key, iv)
+	assert.NoError(err)
+	_, err = io.Copy(io.Discard, reader)
+	assert.NoError(err)
+
+	_, err = encoder.VerifyIntegrity(shardReaders)
+	assert.NoError(err)
+
+	// Scrape the metrics.
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	assert.True(strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain"))
+	assert.Contains(body, `stitch_bytes_in_total{stage="encode"} 20000`)
+	assert.Contains(body, `stitch_bytes_out_total{stage="decode"} 20000`)
+	assert.Contains(body, `stitch_stage_duration_seconds_count{stage="verify"} 1`)
+	assert.Contains(body, `stitch_compression_ratio_count{stage="encode"} 1`)
+	assert.Contains(body, `stitch_corrupt_blocks_total{stage="verify"} 0`)
+
+	// The time spent in each stage of the encoding pipeline should be reported
+	// too.
+	for _, stage := range []string{"read", "hash", "compress", "encrypt", "erasure_code", "write"} {
+		assert.Contains(body, `stitch_stage_duration_seconds_count{stage="`+stage+`"} 1`)
+	}
+
+	// The bytes written when encoding should match the size of the shards.
+	total := shards[0].Len() + shards[1].Len() + shards[2].Len()
+	assert.Contains(body, `stitch_bytes_out_total{stage="encode"} `+strconv.Itoa(total))
+}
@@ -0,0 +1,63 @@
+package stitch
+
+import (
+	"errors"
+	"io"
+
+	"github.com/OhanaFS/stitch/header"
+)
+
+// MigrationResult describes the outcome of MigrateHeader() for a shard.
+type MigrationResult struct {
+	// FromVersion is the header version the shard had before the migration.
+	FromVersion int
+	// Migrated specifies whether the header was rewritten. It is false if the
+	// header was already up to date.
+	Migrated bool
+	// NeedsReencode specifies whether the shard lacks protections that can only
+	// be added by re-encoding the file, e.g. with Rekey(). This is the case for
+	// shards without a file ID, sealed private fields or a header MAC, and for
+	// headers that don't fit in the new format.
+	NeedsReencode bool
+}
+
+// MigrateHeader upgrades the header of the supplied shard to the current header
+// version in place. The header keeps its size, so the data in the shard is left
+// untouched, and the shard remains readable alongside shards that haven't been
+// migrated yet. Only the header at the start of the shard is rewritten, so
+// incomplete shards have to be finalized first.
+//
+// Migrating a shard that is already up to date does nothing, so it is safe to
+// run again after an interruption.
+func (*Encoder) MigrateHeader(shard io.ReadWriteSeeker) (*MigrationResult, error) {
+	// Read the header.
+	hdr, err := readShardHeader(shard)
+	if err != nil {
+		return nil, err
+	}
+	if !hdr.IsComplete {
+		return nil, header.ErrHeaderNotComplete
+	}
+
+	result := &MigrationResult{
+		FromVersion:   hdr.Version,
+		NeedsReencode: len(hdr.FileID) == 0 || len(hdr.Sealed) == 0 || len(hdr.MAC) == 0,
+	}
+	if hdr.Version == header.CurrentVersion {
+		return result, nil
+	}
+
+	// Rewrite the header in the current version, keeping its size.
+	hdr.Version = header.CurrentVersion
+	if err := writeShardHeader(shard, hdr); err != nil {
+		// The header doesn't fit, so the data has to be moved.
+		if errors.Is(err, header.ErrInvalidHeaderSize) {
+			result.NeedsReencode = true
+			return result, nil
+		}
+		return nil, err
+	}
+	result.Migrated = true
+
+	return result, nil
+}
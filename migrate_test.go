@@ -0,0 +1,97 @@
+package stitch_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/OhanaFS/stitch"
+	"github.com/OhanaFS/stitch/header"
+	"github.com/OhanaFS/stitch/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// downgradeShard rewrites the shard with a version 1 header, as it would have
+// been written before version 2 headers were introduced. The MAC is dropped, as
+// it covers the header size.
+func downgradeShard(t *testing.T, shard *util.Membuf) *util.Membuf {
+	_, err := shard.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	hdr, err := header.Read(shard)
+	assert.NoError(t, err)
+	data, err := io.ReadAll(shard)
+	assert.NoError(t, err)
+
+	hdr.Version, hdr.Size = 1, 0
+	hdr.MAC = nil
+	b, err := hdr.Encode()
+	assert.NoError(t, err)
+
+	out := util.NewMembuf()
+	_, err = out.Write(append(b, data...))
+	assert.NoError(t, err)
+	return out
+}
+
+func TestMigrateHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+	})
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	input := make([]byte, 10000)
+	_, err := rand.Read(input)
+	assert.NoError(err)
+
+	// Encode the data, and convert the shards to version 1 headers.
+	shards := make([]*util.Membuf, 3)
+	shardWriters := make([]io.Writer, 3)
+	for i := range shards {
+		shards[i] = util.NewMembuf()
+		shardWriters[i] = shards[i]
+	}
+	_, err = encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+	assert.NoError(err)
+	for i, shard := range shards {
+		assert.NoError(encoder.FinalizeHeader(shard))
+		shards[i] = downgradeShard(t, shard)
+	}
+	readers := []io.ReadSeeker{shards[0], shards[1], shards[2]}
+
+	decode := func() {
+		reader, err := encoder.NewReadSeeker(readers, key, iv)
+		assert.NoError(err)
+		output, err := io.ReadAll(reader)
+		assert.NoError(err)
+		assert.Equal(input, output)
+	}
+	decode()
+
+	// Migrate a single shard, which should be readable with the others.
+	size := len(shards[0].Bytes())
+	res, err := encoder.MigrateHeader(shards[0])
+	assert.NoError(err)
+	assert.Equal(&stitch.MigrationResult{FromVersion: 1, Migrated: true,
+		NeedsReencode: true}, res)
+	assert.Len(shards[0].Bytes(), size)
+	assert.Equal(header.MagicBytesV2, shards[0].Bytes()[:8])
+	decode()
+
+	// Migrate the rest, and then all of them again.
+	for i := 0; i < 2; i++ {
+		for _, shard := range shards {
+			_, err := encoder.MigrateHeader(shard)
+			assert.NoError(err)
+		}
+	}
+	res, err = encoder.MigrateHeader(shards[0])
+	assert.NoError(err)
+	assert.Equal(&stitch.MigrationResult{FromVersion: 2, NeedsReencode: true}, res)
+	decode()
+}
@@ -0,0 +1,62 @@
+package stitch
+
+import "math/bits"
+
+// PaddingPolicy specifies how the compressed data is padded before it is
+// encrypted, so that the size of the shards doesn't reveal the exact size of
+// the file. The padding is encrypted along with the data, and is stripped when
+// decoding.
+type PaddingPolicy uint8
+
+const (
+	// PaddingNone doesn't pad the data.
+	PaddingNone PaddingPolicy = iota
+	// PaddingPowerOfTwo pads the data up to the next power of two. This leaks
+	// the least information, but can nearly double the size of the data.
+	PaddingPowerOfTwo
+	// PaddingPadme pads the data using the PADMÉ scheme, which leaks
+	// O(log log n) bits of information about the size, with an overhead of at
+	// most 12%.
+	PaddingPadme
+	// PaddingMultiple pads the data up to the next multiple of
+	// EncoderOptions.PaddingMultiple bytes.
+	PaddingMultiple
+)
+
+// paddedSize returns the size that data of the given size should be padded to,
+// according to the padding policy.
+func paddedSize(size uint64, policy PaddingPolicy, multiple uint64) uint64 {
+	if size == 0 {
+		return 0
+	}
+
+	switch policy {
+	case PaddingPowerOfTwo:
+		if size&(size-1) == 0 {
+			return size
+		}
+		return 1 << bits.Len64(size)
+
+	case PaddingPadme:
+		// E is the exponent of the size, S is the number of bits required to
+		// represent E. The lowest E-S bits of the size are rounded up.
+		e := uint64(bits.Len64(size) - 1)
+		if e == 0 {
+			return size
+		}
+		s := uint64(bits.Len64(e))
+		mask := uint64(1)<<(e-s) - 1
+		return (size + mask) &^ mask
+
+	case PaddingMultiple:
+		if multiple == 0 {
+			return size
+		}
+		if remainder := size % multiple; remainder != 0 {
+			return size + multiple - remainder
+		}
+		return size
+	}
+
+	return size
+}
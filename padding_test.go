@@ -0,0 +1,108 @@
+package stitch_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/OhanaFS/stitch"
+	"github.com/OhanaFS/stitch/header"
+	"github.com/OhanaFS/stitch/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPadding(t *testing.T) {
+	assert := assert.New(t)
+
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	// runTest encodes and decodes the input with the padding policy, and
+	// returns the encrypted size from the header.
+	runTest := func(input []byte, policy stitch.PaddingPolicy, multiple uint64) uint64 {
+		shards := make([]*util.Membuf, 3)
+		shardWriters := make([]io.Writer, 3)
+		shardReaders := make([]io.ReadSeeker, 3)
+		for i := 0; i < 3; i++ {
+			shards[i] = util.NewMembuf()
+			shardWriters[i] = shards[i]
+			shardReaders[i] = shards[i]
+		}
+
+		encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+			DataShards:      2,
+			ParityShards:    1,
+			KeyThreshold:    2,
+			Padding:         policy,
+			PaddingMultiple: multiple,
+		})
+		_, err := encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+		assert.NoError(err)
+		for _, shard := range shards {
+			assert.NoError(encoder.FinalizeHeader(shard))
+		}
+
+		// The padding should be stripped when decoding.
+		reader, err := encoder.NewReadSeeker(shardReaders, key, iv)
+		assert.NoError(err)
+		output, err := io.ReadAll(reader)
+		assert.NoError(err)
+		assert.Equal(input, output)
+
+		hdr := header.NewHeader()
+		assert.NoError(hdr.Decode(shards[0].Bytes()))
+		return hdr.EncryptedSize
+	}
+
+	// chunks returns the number of AES chunks in the encrypted data.
+	chunks := func(encryptedSize uint64) uint64 {
+		return encryptedSize / (1024 + 16)
+	}
+
+	small := make([]byte, 3000)
+	_, err := rand.Read(small)
+	assert.NoError(err)
+	large := make([]byte, 5000)
+	_, err = rand.Read(large)
+	assert.NoError(err)
+
+	// Without padding, the sizes are different.
+	assert.NotEqual(runTest(small, stitch.PaddingNone, 0),
+		runTest(large, stitch.PaddingNone, 0))
+
+	// Padding to a multiple hides the difference.
+	assert.Equal(uint64(64), chunks(runTest(small, stitch.PaddingMultiple, 65536)))
+	assert.Equal(uint64(64), chunks(runTest(large, stitch.PaddingMultiple, 65536)))
+
+	// Padding to a power of two rounds up to the next power of two.
+	assert.Equal(uint64(4), chunks(runTest(small, stitch.PaddingPowerOfTwo, 0)))
+	assert.Equal(uint64(8), chunks(runTest(large, stitch.PaddingPowerOfTwo, 0)))
+
+	// PADMÉ pads by less than the power of two.
+	assert.Equal(uint64(5), chunks(runTest(large, stitch.PaddingPadme, 0)))
+
+	// A multiple has to be given with PaddingMultiple.
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+		Padding:      stitch.PaddingMultiple,
+	})
+	_, err = encoder.Encode(bytes.NewReader(small),
+		[]io.Writer{util.NewMembuf(), util.NewMembuf(), util.NewMembuf()}, key, iv)
+	assert.ErrorIs(err, stitch.ErrInvalidPadding)
+	_, err = encoder.EstimateShardSize(uint64(len(small)), 1)
+	assert.ErrorIs(err, stitch.ErrInvalidPadding)
+
+	// Multiples that don't fit in 32 bits are rounded up to as well.
+	encoder = stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:      2,
+		ParityShards:    1,
+		Padding:         stitch.PaddingMultiple,
+		PaddingMultiple: 1<<33 + 1,
+	})
+	est, err := encoder.EstimateShardSize(uint64(len(small)), 1)
+	assert.NoError(err)
+	assert.Equal(uint64(1<<33+1), est.PaddedSize)
+}
@@ -0,0 +1,224 @@
+package stitch
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// Stage identifies the operation that progress is being reported for, or the
+// stage of the encoding pipeline that a metric is reported for.
+type Stage int
+
+const (
+	// StageEncode is reported by Encode(), with the number of plaintext bytes
+	// read.
+	StageEncode Stage = iota
+	// StageDecode is reported by the readers returned by NewReadSeeker() and by
+	// Decode(), with the number of plaintext bytes decoded.
+	StageDecode
+	// StageVerify is reported by VerifyIntegrity(), with the number of shard
+	// bytes verified.
+	StageVerify
+	// StageRekey is reported by Rekey(), with the number of encrypted bytes
+	// re-encrypted.
+	StageRekey
+	// StageSalvage is reported by Salvage(), with the number of plaintext bytes
+	// recovered from shards that couldn't be finalized.
+	StageSalvage
+
+	// StageRead, StageHash, StageCompress, StageEncrypt, StageErasureCode and
+	// StageWrite are the stages of the encoding pipeline. They are only
+	// reported to Metrics, with the time spent in each of them as given by
+	// StageTimings.
+	StageRead
+	StageHash
+	StageCompress
+	StageEncrypt
+	StageErasureCode
+	StageWrite
+)
+
+func (s Stage) String() string {
+	switch s {
+	case StageEncode:
+		return "encode"
+	case StageDecode:
+		return "decode"
+	case StageVerify:
+		return "verify"
+	case StageRekey:
+		return "rekey"
+	case StageSalvage:
+		return "salvage"
+	case StageRead:
+		return "read"
+	case StageHash:
+		return "hash"
+	case StageCompress:
+		return "compress"
+	case StageEncrypt:
+		return "encrypt"
+	case StageErasureCode:
+		return "erasure_code"
+	case StageWrite:
+		return "write"
+	default:
+		return "unknown"
+	}
+}
+
+// Progress describes how far along an operation is.
+type Progress struct {
+	// Stage is the operation being performed.
+	Stage Stage
+	// Bytes is the number of bytes processed so far.
+	Bytes int64
+	// Total is the number of bytes to be processed, or 0 if it isn't known.
+	Total int64
+	// Elapsed is the time since the operation started.
+	Elapsed time.Duration
+	// Throughput is the average number of bytes processed per second.
+	Throughput float64
+	// ETA is the estimated time left, or 0 if it isn't known.
+	ETA time.Duration
+	// Done is set on the last report of the operation.
+	Done bool
+}
+
+// ProgressFunc receives progress reports. It is called from the goroutine
+// doing the work, so it should return quickly.
+type ProgressFunc func(Progress)
+
+// progressInterval is the minimum time between progress reports, apart from
+// the first and the last one.
+const progressInterval = 100 * time.Millisecond
+
+// progressTracker keeps track of the progress of an operation, and reports it
+// to a ProgressFunc. A nil progressTracker does nothing, so that it can be used
+// without checking whether a ProgressFunc was supplied.
+type progressTracker struct {
+	fn         ProgressFunc
+	stage      Stage
+	total      int64
+	bytes      int64
+	start      time.Time
+	lastReport time.Time
+	done       bool
+}
+
+// newProgress starts tracking the progress of an operation. It returns nil if
+// no ProgressFunc was set in the options.
+func (e *Encoder) newProgress(stage Stage, total int64) *progressTracker {
+	if e.opts.Progress == nil {
+		return nil
+	}
+	t := &progressTracker{
+		fn:    e.opts.Progress,
+		stage: stage,
+		total: total,
+		start: time.Now(),
+	}
+	t.report()
+	return t
+}
+
+// add adds n bytes to the progress.
+func (t *progressTracker) add(n int64) {
+	if t == nil {
+		return
+	}
+	t.set(t.bytes + n)
+}
+
+// set sets the progress to n bytes.
+func (t *progressTracker) set(n int64) {
+	if t == nil || t.done {
+		return
+	}
+	t.bytes = n
+	if time.Since(t.lastReport) >= progressInterval {
+		t.report()
+	}
+}
+
+// finish sends the last report of the operation.
+func (t *progressTracker) finish() {
+	if t == nil || t.done {
+		return
+	}
+	t.done = true
+	t.report()
+}
+
+func (t *progressTracker) report() {
+	now := time.Now()
+	t.lastReport = now
+	p := Progress{
+		Stage:   t.stage,
+		Bytes:   t.bytes,
+		Total:   t.total,
+		Elapsed: now.Sub(t.start),
+		Done:    t.done,
+	}
+	if p.Elapsed > 0 {
+		p.Throughput = float64(p.Bytes) / p.Elapsed.Seconds()
+	}
+	if p.Total > p.Bytes && p.Throughput > 0 {
+		p.ETA = time.Duration(float64(p.Total-p.Bytes) / p.Throughput * float64(time.Second))
+	}
+	t.fn(p)
+}
+
+// progressReadSeeker reports the position of the underlying reader as the
+// progress of the operation. onEOF is called the first time the end of the
+// reader is reached, if it is set.
+type progressReadSeeker struct {
+	reader   io.ReadSeeker
+	progress *progressTracker
+	pos      int64
+	onEOF    func()
+}
+
+func (r *progressReadSeeker) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.pos += int64(n)
+	r.progress.set(r.pos)
+	if err == io.EOF {
+		r.progress.finish()
+		if r.onEOF != nil {
+			r.onEOF()
+			r.onEOF = nil
+		}
+	}
+	return n, err
+}
+
+func (r *progressReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.reader.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
+
+// inputSize returns the size of the data that can be read from a reader, or 0
+// if it isn't known. Readers that report their remaining length, such as
+// *bytes.Reader, and files are supported.
+func inputSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case *os.File:
+		stat, err := r.Stat()
+		if err != nil || !stat.Mode().IsRegular() {
+			return 0
+		}
+		pos, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0
+		}
+		return stat.Size() - pos
+	}
+	return 0
+}
@@ -0,0 +1,79 @@
+package stitch_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/OhanaFS/stitch"
+	"github.com/OhanaFS/stitch/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgress(t *testing.T) {
+	assert := assert.New(t)
+
+	input := make([]byte, 100000)
+	_, err := rand.Read(input)
+	assert.NoError(err)
+
+	var reports []stitch.Progress
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+		Progress: func(p stitch.Progress) {
+			reports = append(reports, p)
+		},
+	})
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	// checkReports checks that the reports are for the stage, and that the last
+	// one is done with every byte processed.
+	checkReports := func(stage stitch.Stage, total int64) {
+		if !assert.NotEmpty(reports) {
+			return
+		}
+		for _, p := range reports {
+			assert.Equal(stage, p.Stage)
+			assert.Equal(total, p.Total)
+		}
+		last := reports[len(reports)-1]
+		assert.True(last.Done)
+		assert.Equal(total, last.Bytes)
+		reports = nil
+	}
+
+	shards := make([]*util.Membuf, 3)
+	shardWriters := make([]io.Writer, 3)
+	shardReaders := make([]io.ReadSeeker, 3)
+	for i := range shards {
+		shards[i] = util.NewMembuf()
+		shardWriters[i] = shards[i]
+		shardReaders[i] = shards[i]
+	}
+	_, err = encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+	assert.NoError(err)
+	checkReports(stitch.StageEncode, int64(len(input)))
+
+	reader, err := encoder.NewReadSeeker(shardReaders, key, iv)
+	assert.NoError(err)
+	_, err = io.Copy(io.Discard, reader)
+	assert.NoError(err)
+	checkReports(stitch.StageDecode, int64(len(input)))
+
+	err = encoder.Decode(io.Discard, []io.Reader{
+		bytes.NewReader(shards[0].Bytes()),
+		bytes.NewReader(shards[1].Bytes()),
+		bytes.NewReader(shards[2].Bytes()),
+	}, key, iv)
+	assert.NoError(err)
+	checkReports(stitch.StageDecode, int64(len(input)))
+
+	_, err = encoder.VerifyIntegrity(shardReaders)
+	assert.NoError(err)
+	checkReports(stitch.StageVerify,
+		int64(shards[0].Len()+shards[1].Len()+shards[2].Len()))
+}
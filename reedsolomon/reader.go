@@ -2,6 +2,7 @@ package reedsolomon
 
 import (
 	"bytes"
+	"context"
 	"io"
 
 	"github.com/OhanaFS/stitch/util"
@@ -21,7 +22,8 @@ type ReadSeeker struct {
 	bytesToDiscard int64
 }
 
-// NewReadSeeker returns a new ReaderSeeker
+// NewReadSeeker returns a new ReaderSeeker. Missing shards may be nil, and are
+// reconstructed from the other shards.
 func NewReadSeeker(encoder *Encoder, shards []io.ReadSeeker, outSize int64) io.ReadSeeker {
 	return util.NewLimitReader(&ReadSeeker{
 		encoder:       encoder,
@@ -52,11 +54,15 @@ func (r *ReadSeeker) Read(p []byte) (int, error) {
 	// Set up readers
 	readers := make([]io.Reader, len(r.shards))
 	for i, shard := range r.shards {
-		readers[i] = shard
+		if shard != nil {
+			readers[i] = shard
+		}
 	}
 
 	// Read the data
-	err := r.encoder.Join(buf, readers, int64(buf.Cap()))
+	firstBlock := r.currentOffset / (int64(r.encoder.BlockSize) * int64(r.encoder.DataShards))
+	err := r.encoder.join(context.Background(), buf, readers, int64(buf.Cap()),
+		int(firstBlock))
 	if err != nil {
 		return 0, err
 	}
@@ -93,6 +99,9 @@ func (r *ReadSeeker) Seek(offset int64, whence int) (int64, error) {
 
 	// Seek each shard
 	for _, shard := range r.shards {
+		if shard == nil {
+			continue
+		}
 		if _, err := shard.Seek(shardOffset, io.SeekStart); err != nil {
 			return 0, err
 		}
@@ -2,6 +2,7 @@ package reedsolomon
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"fmt"
@@ -32,6 +33,11 @@ type Encoder struct {
 	ParityShards int
 	BlockSize    int
 	encoder      rs.Encoder
+
+	// OnCorruptBlock is called when joining shards, for each block of a shard
+	// that fails its hash check and has to be reconstructed. It may be called
+	// from another goroutine.
+	OnCorruptBlock func(shard, block int)
 }
 
 func NewEncoder(dataShards, parityShards, blockSize int) (*Encoder, error) {
@@ -193,8 +199,24 @@ func (w *Writer) Close() error {
 
 // Join reconstructs the data from the shards given to it. If it detects that
 // some of the shards are corrupted, but is able to correct them, it should return
-// ErrCorruptionDetected.
+// ErrCorruptionDetected. If outSize is negative, the shards are read until they
+// end, and every block is written out, including the padding of the last one.
 func (e *Encoder) Join(dst io.Writer, shards []io.Reader, outSize int64) error {
+	return e.JoinContext(context.Background(), dst, shards, outSize)
+}
+
+// JoinContext is like Join, but stops before each block once the context is
+// done, returning the context's error.
+func (e *Encoder) JoinContext(ctx context.Context, dst io.Writer, shards []io.Reader,
+	outSize int64) error {
+	return e.join(ctx, dst, shards, outSize, 0)
+}
+
+// join reconstructs the data from the shards, which are positioned at block
+// firstBlock, so that corrupt blocks are reported with their index in the
+// shard.
+func (e *Encoder) join(ctx context.Context, dst io.Writer, shards []io.Reader,
+	outSize int64, firstBlock int) error {
 	totalShards := e.DataShards + e.ParityShards
 	if len(shards) != totalShards {
 		return fmt.Errorf("expected %d shards, got %d", totalShards, len(shards))
@@ -226,17 +248,31 @@ func (e *Encoder) Join(dst io.Writer, shards []io.Reader, outSize int64) error {
 	for {
 		currentBlock += 1
 
+		// Stop if the context is done.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		// Read shard blocks.
+		first := true
 		for i, shard := range shards {
 			if shard == nil {
+				// Missing shards are regenerated by `enc.Reconstruct`.
+				bufs[i] = []byte{}
 				continue
 			}
 
-			if _, err := shard.Read(bufs[i]); err != nil {
+			_, err := io.ReadFull(shard, bufs[i])
+			if err == io.EOF && first && outSize < 0 {
+				// The shards ended on a block boundary.
+				return nil
+			}
+			first = false
+			if err != nil {
 				return fmt.Errorf("failed to read from shard %d, block %d: %w", i, currentBlock, err)
 			}
 
-			if _, err := shard.Read(hashes[i]); err != nil {
+			if _, err := io.ReadFull(shard, hashes[i]); err != nil {
 				return fmt.Errorf("failed to read hash from shard %d, block %d: %w", i, currentBlock, err)
 			}
 
@@ -247,6 +283,9 @@ func (e *Encoder) Join(dst io.Writer, shards []io.Reader, outSize int64) error {
 				// will regenerate it.
 				bufs[i] = []byte{}
 				brokenBlocks++
+				if e.OnCorruptBlock != nil {
+					e.OnCorruptBlock(i, firstBlock+currentBlock)
+				}
 			}
 		}
 
@@ -266,7 +305,7 @@ func (e *Encoder) Join(dst io.Writer, shards []io.Reader, outSize int64) error {
 
 		// Join the shards.
 		blockSize := int64(e.BlockSize) * int64(e.DataShards)
-		if bytesLeft < blockSize {
+		if outSize >= 0 && bytesLeft < blockSize {
 			blockSize = bytesLeft
 		}
 		if err = enc.Join(dst, bufs, int(blockSize)); err != nil {
@@ -275,7 +314,7 @@ func (e *Encoder) Join(dst io.Writer, shards []io.Reader, outSize int64) error {
 
 		// Update the number of bytes left.
 		bytesLeft -= blockSize
-		if bytesLeft <= 0 {
+		if outSize >= 0 && bytesLeft <= 0 {
 			break
 		}
 
@@ -290,9 +329,33 @@ func (e *Encoder) Join(dst io.Writer, shards []io.Reader, outSize int64) error {
 
 // NewReader wraps the Join method and returns a new io.ReadCloser.
 func (e *Encoder) NewReader(shards []io.Reader, outSize int64) io.ReadCloser {
+	return e.NewReaderContext(context.Background(), shards, outSize)
+}
+
+// NewReaderContext wraps the JoinContext method and returns a new
+// io.ReadCloser. The goroutine doing the work exits once the context is done or
+// the reader is closed, even if the reader is no longer being read from.
+func (e *Encoder) NewReaderContext(ctx context.Context, shards []io.Reader,
+	outSize int64) io.ReadCloser {
 	r, w := io.Pipe()
+
+	// Close the pipe once the context is done, as JoinContext only checks the
+	// context between blocks, and would otherwise stay blocked writing to the
+	// pipe.
+	done := make(chan struct{})
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				w.CloseWithError(ctx.Err())
+			case <-done:
+			}
+		}()
+	}
+
 	go func() {
-		if err := e.Join(w, shards, outSize); err != nil {
+		defer close(done)
+		if err := e.JoinContext(ctx, w, shards, outSize); err != nil {
 			w.CloseWithError(err)
 		} else {
 			w.Close()
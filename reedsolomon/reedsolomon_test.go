@@ -1,9 +1,12 @@
 package reedsolomon_test
 
 import (
+	"context"
 	"io"
 	"log"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/orcaman/writerseeker"
 	"github.com/stretchr/testify/assert"
@@ -45,6 +48,14 @@ func TestReedSolomon(t *testing.T) {
 	assert.Nil(err)
 	assert.Equal(data, b)
 
+	// Without a size, the shards should be read until they end.
+	readers = getReadersFromShards(t, blockSize, shards)
+	dest = &writerseeker.WriterSeeker{}
+	assert.NoError(rs.Join(dest, readers, -1))
+	b, err = io.ReadAll(dest.BytesReader())
+	assert.Nil(err)
+	assert.Equal(data, b)
+
 	// Corrupt one of the shards
 	readers = make([]io.Reader, totalShards)
 	for i := 0; i < totalShards; i++ {
@@ -103,6 +114,43 @@ func TestReedSolomonLarge(t *testing.T) {
 	assert.Equal(data, b)
 }
 
+func TestReaderContext(t *testing.T) {
+	assert := assert.New(t)
+
+	blockSize := 32
+	dataShards := 5
+	parityShards := 2
+
+	data := makeData(blockSize * dataShards * 10)
+	shards, writers := makeShardBuffer(dataShards + parityShards)
+	rs, err := reedsolomon.NewEncoder(dataShards, parityShards, blockSize)
+	assert.Nil(err)
+	w := reedsolomon.NewWriter(writers, rs)
+	_, err = w.Write(data)
+	assert.Nil(err)
+	assert.Nil(w.Close())
+
+	// Read a little so that the goroutine behind the reader is blocked writing
+	// to it, then cancel the context without reading any further or closing the
+	// reader. The goroutine should still exit.
+	goroutines := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	r := rs.NewReaderContext(ctx, getReadersFromShards(t, blockSize, shards),
+		int64(len(data)))
+	_, err = r.Read(make([]byte, 1))
+	assert.NoError(err)
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(goroutines, runtime.NumGoroutine())
+
+	// The reader should report the context's error.
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(err, context.Canceled)
+}
+
 func makeData(size int) []byte {
 	data := make([]byte, size)
 	for i := 0; i < len(data); i++ {
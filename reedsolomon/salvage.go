@@ -0,0 +1,59 @@
+package reedsolomon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+)
+
+// JoinPrefix reconstructs as much data as possible from shards of unknown
+// length, such as the shards of an encode that was interrupted. Blocks are read
+// until a block cannot be recovered, because too few shards have a complete
+// block with a matching hash. Nil shards are treated as missing. It returns the
+// number of bytes written to dst, which includes any padding of the last block.
+func (e *Encoder) JoinPrefix(dst io.Writer, shards []io.Reader) (int64, error) {
+	totalShards := e.DataShards + e.ParityShards
+	bufs := make([][]byte, totalShards)
+	hash := make([]byte, sha256.Size)
+	written := int64(0)
+
+	for {
+		// Read the next block from each shard, keeping only the intact ones.
+		intact := 0
+		for i := range bufs {
+			bufs[i] = nil
+			if i >= len(shards) || shards[i] == nil {
+				continue
+			}
+			block := make([]byte, e.BlockSize)
+			if _, err := io.ReadFull(shards[i], block); err != nil {
+				continue
+			}
+			if _, err := io.ReadFull(shards[i], hash); err != nil {
+				continue
+			}
+			if computed := sha256.Sum256(block); !bytes.Equal(hash, computed[:]) {
+				continue
+			}
+			bufs[i] = block
+			intact++
+		}
+
+		// Stop at the first block that cannot be recovered.
+		if intact < e.DataShards {
+			return written, nil
+		}
+		if err := e.encoder.ReconstructData(bufs); err != nil {
+			return written, nil
+		}
+
+		// Write the data blocks.
+		for _, block := range bufs[:e.DataShards] {
+			n, err := dst.Write(block)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+}
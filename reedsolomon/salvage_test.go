@@ -0,0 +1,51 @@
+package reedsolomon_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/OhanaFS/stitch/reedsolomon"
+)
+
+func TestJoinPrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	blockSize := 32
+	dataShards := 3
+	parityShards := 2
+
+	totalShards := dataShards + parityShards
+	data := makeData(blockSize * dataShards * 10)
+	shards, writers := makeShardBuffer(totalShards)
+
+	rs, err := reedsolomon.NewEncoder(dataShards, parityShards, blockSize)
+	assert.NoError(err)
+
+	// Encode the data
+	w := reedsolomon.NewWriter(writers, rs)
+	_, err = w.Write(data)
+	assert.NoError(err)
+	assert.NoError(w.Close())
+
+	// Cut the shards off at different points, as if the encode was interrupted,
+	// and lose one of them.
+	stride := blockSize + reedsolomon.BlockOverhead
+	cuts := []int{4*stride + 5, 6 * stride, 5*stride + 20, 7 * stride, 0}
+	readers := make([]io.Reader, totalShards)
+	for i, shard := range shards {
+		b, err := io.ReadAll(shard.BytesReader())
+		assert.NoError(err)
+		readers[i] = bytes.NewReader(b[:cuts[i]])
+	}
+	readers[4] = nil
+
+	// The first 5 blocks can be recovered from 3 of the shards.
+	dest := &bytes.Buffer{}
+	n, err := rs.JoinPrefix(dest, readers)
+	assert.NoError(err)
+	assert.Equal(int64(5*blockSize*dataShards), n)
+	assert.Equal(data[:n], dest.Bytes())
+}
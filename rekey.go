@@ -0,0 +1,189 @@
+package stitch
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	aesgcm "github.com/OhanaFS/stitch/aes"
+	"github.com/OhanaFS/stitch/header"
+	"github.com/OhanaFS/stitch/reedsolomon"
+	"github.com/OhanaFS/stitch/util"
+)
+
+// Rekey re-encrypts the data contained within the supplied shards with a newly
+// generated file key, and writes the result to a new set of shards. Unlike
+// RotateKeys(), which only re-wraps the existing file key, this replaces the
+// file key itself, so it should be used when the file key is compromised.
+//
+// The data is decrypted with the old file key and re-encrypted with the new
+// one in a single pass, without being decompressed. The new file key is wrapped
+// with newKey and newIv. As with Encode(), the output writers are not closed,
+// and the new shards must be finalized using the FinalizeHeader() function,
+// unless they implement io.WriterAt.
+func (e *Encoder) Rekey(shards []io.ReadSeeker, dst []io.Writer,
+	key, iv, newKey, newIv []byte) (*EncodingResult, error) {
+	totalShards := int(e.opts.DataShards + e.opts.ParityShards)
+
+	// Check if the number of output writers matches the number of shards in the
+	// encoder options.
+	if len(dst) != totalShards {
+		return nil, ErrShardCountMismatch
+	}
+
+	// Open the encrypted data contained within the old shards.
+	start := time.Now()
+	hdr, priv, fileKey, rRS, err := e.openEncryptedStream(shards, key, iv)
+	if err != nil {
+		return nil, err
+	}
+	bytesIn := new(int64)
+	rRS = countingReadSeeker{ReadSeeker: rRS, n: bytesIn}
+
+	// Prepare the AES reader to decrypt the data with the old file key. All of
+	// the encrypted chunks are decrypted, so that any padding is preserved. The
+	// encrypted data is read a whole Reed-Solomon stripe at a time.
+	stripeSize := hdr.RSBlockSize * int(e.opts.DataShards)
+	chunks := hdr.EncryptedSize / uint64(hdr.AESBlockSize+aesgcm.Overhead)
+	rAES, err := aesgcm.NewStreamReader(bufio.NewReaderSize(rRS, stripeSize),
+		fileKey, hdr.AESBlockSize, chunks*uint64(hdr.AESBlockSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES reader: %v", err)
+	}
+
+	// Prepare a new 256-bit AES key to encrypt the data.
+	newFileKey := make([]byte, 32)
+	if _, err := rand.Read(newFileKey); err != nil {
+		return nil, fmt.Errorf("failed to generate file key: %v", err)
+	}
+
+	// Encrypt and split the new key into the number of shards.
+	fileKeySplit, err := splitFileKey(newFileKey, newKey, newIv, totalShards, int(e.opts.KeyThreshold))
+	if err != nil {
+		return nil, fmt.Errorf("failed to split file key: %v", err)
+	}
+
+	// Generate a new ID for the new shards, so that they can't be mixed with the
+	// old ones.
+	fileID := make([]byte, fileIDSize)
+	if _, err := rand.Read(fileID); err != nil {
+		return nil, fmt.Errorf("failed to generate file ID: %v", err)
+	}
+
+	// Prepare headers for each new shard, based on the old header.
+	keyCheck := keyCheckValue(newKey, newIv, fileID)
+	headers := make([]header.Header, totalShards)
+	for i := 0; i < totalShards; i++ {
+		headers[i] = hdr
+		headers[i].Version = header.CurrentVersion
+		headers[i].Size = header.DefaultSize
+		headers[i].ShardIndex = i
+		headers[i].ShardCount = totalShards
+		headers[i].DataShards = int(e.opts.DataShards)
+		headers[i].Trailer = e.opts.KeepTrailer || e.opts.Streaming
+		headers[i].Footer = e.opts.Streaming
+		headers[i].FileID = fileID
+		headers[i].FileKey = fileKeySplit[i]
+		headers[i].KeyCheck = keyCheck
+		headers[i].KeyGeneration = 0
+		headers[i].PendingFileKey = nil
+		headers[i].PendingKeyCheck = nil
+		headers[i].PendingMAC = nil
+		headers[i].FileHash = nil
+		headers[i].FileSize = 0
+		headers[i].CompressedSize = 0
+		headers[i].Sealed = nil
+		headers[i].MAC = nil
+		headers[i].IsComplete = false
+	}
+
+	// Compute the digests of the new shards on the fly in streaming mode.
+	var timings StageTimings
+	var digests []*digestWriter
+	outputs := dst
+	if e.opts.ShardDigests && e.opts.Streaming {
+		digests = make([]*digestWriter, totalShards)
+		outputs = make([]io.Writer, totalShards)
+		for i := range dst {
+			digests[i] = newDigestWriter(dst[i], &timings.Hash)
+			outputs[i] = digests[i]
+		}
+	}
+
+	// Write the headers to the new shards.
+	if err := writeHeaders(outputs, headers); err != nil {
+		return nil, err
+	}
+
+	// Prepare the Reed-Solomon writer.
+	encRS, err := reedsolomon.NewEncoder(
+		int(e.opts.DataShards), int(e.opts.ParityShards), hdr.RSBlockSize,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Reed-Solomon encoder: %v", err)
+	}
+	wRS := reedsolomon.NewWriter(outputs, encRS)
+
+	// Prepare the AES writer to encrypt the data with the new file key.
+	wAES, err := aesgcm.NewWriter(wRS, newFileKey, hdr.AESBlockSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES writer: %v", err)
+	}
+
+	// Re-encrypt the data.
+	progress := e.newProgress(StageRekey, int64(chunks)*int64(hdr.AESBlockSize))
+	rProgress := util.NewProgressReader(rAES, func(n int) {
+		progress.add(int64(n))
+	})
+	if _, err := io.Copy(wAES, rProgress); err != nil {
+		return nil, fmt.Errorf("failed to re-encrypt data: %w", err)
+	}
+
+	// Close the writers
+	if err := wAES.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close aes writer: %v", err)
+	}
+	if err := wRS.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close reed-solomon writer: %v", err)
+	}
+
+	// Seal the private header fields with the new file key.
+	if err := headers[0].SealPrivate(newFileKey, priv); err != nil {
+		return nil, fmt.Errorf("failed to seal header: %v", err)
+	}
+
+	// Write the complete header to the new shards.
+	for i := 0; i < totalShards; i++ {
+		headers[i].Sealed = headers[0].Sealed
+		headers[i].EncryptedSize = wAES.(*aesgcm.AESWriter).GetWritten()
+		headers[i].IsComplete = true
+		headers[i].MAC = headers[i].ComputeMAC(newFileKey)
+	}
+	patched, err := writeCompleteHeaders(outputs, headers)
+	if err != nil {
+		return nil, err
+	}
+	shardResults, err := e.shardResults(dst, headers, patched, digests, &timings.Hash)
+	if err != nil {
+		return nil, err
+	}
+	progress.finish()
+	e.recordStage(StageRekey, start, atomic.LoadInt64(bytesIn),
+		int64(totalShards)*shardSize(&headers[0]))
+
+	timings.Total = time.Since(start)
+
+	return &EncodingResult{
+		FileSize:       priv.FileSize,
+		FileHash:       priv.FileHash,
+		FileID:         fileID,
+		CompressedSize: priv.CompressedSize,
+		EncryptedSize:  headers[0].EncryptedSize,
+		Shards:         shardResults,
+		Timings:        timings,
+		Digests:        loadedSums(priv.Digests),
+	}, nil
+}
@@ -0,0 +1,99 @@
+package stitch_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/OhanaFS/stitch"
+	"github.com/OhanaFS/stitch/header"
+	"github.com/OhanaFS/stitch/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRekey(t *testing.T) {
+	assert := assert.New(t)
+
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+	})
+
+	// Generate some input
+	input := make([]byte, 20000)
+	_, err := rand.Read(input)
+	assert.NoError(err)
+
+	key1 := []byte("00000000000000000000000000000000")
+	iv1 := []byte("000000000000")
+	key2 := []byte("11111111111111111111111111111111")
+	iv2 := []byte("111111111111")
+
+	makeShards := func() ([]*util.Membuf, []io.Writer, []io.ReadSeeker) {
+		shards := make([]*util.Membuf, 3)
+		writers := make([]io.Writer, 3)
+		readers := make([]io.ReadSeeker, 3)
+		for i := range shards {
+			shards[i] = util.NewMembuf()
+			writers[i] = shards[i]
+			readers[i] = shards[i]
+		}
+		return shards, writers, readers
+	}
+
+	// Encode the data.
+	oldShards, oldWriters, oldReaders := makeShards()
+	res, err := encoder.Encode(bytes.NewReader(input), oldWriters, key1, iv1)
+	assert.NoError(err)
+	for _, shard := range oldShards {
+		assert.NoError(encoder.FinalizeHeader(shard))
+	}
+
+	// Re-encrypt the data with a new file key.
+	newShards, newWriters, newReaders := makeShards()
+	rekeyRes, err := encoder.Rekey(oldReaders, newWriters, key1, iv1, key2, iv2)
+	assert.NoError(err)
+	assert.Equal(res.FileSize, rekeyRes.FileSize)
+	assert.Equal(res.FileHash, rekeyRes.FileHash)
+	for _, shard := range newShards {
+		assert.NoError(encoder.FinalizeHeader(shard))
+	}
+
+	// The ciphertext should be different.
+	assert.NotEqual(oldShards[0].Bytes(), newShards[0].Bytes())
+
+	// The old key should no longer work.
+	_, err = encoder.NewReadSeeker(newReaders, key1, iv1)
+	assert.ErrorIs(err, stitch.ErrWrongKey)
+
+	// The new shards should decode to the same data.
+	reader, err := encoder.NewReadSeeker(newReaders, key2, iv2)
+	assert.NoError(err)
+	output, err := io.ReadAll(reader)
+	assert.NoError(err)
+	assert.Equal(input, output)
+
+	// A half-finished key rotation of the old shards shouldn't be carried over
+	// to the new ones.
+	assert.NoError(encoder.PrepareKeyRotation(
+		[]io.ReadWriteSeeker{oldShards[0], oldShards[1], oldShards[2]},
+		key1, iv1, key2, iv2))
+	newShards, newWriters, newReaders = makeShards()
+	_, err = encoder.Rekey(oldReaders, newWriters, key1, iv1, key2, iv2)
+	assert.NoError(err)
+	for _, shard := range newShards {
+		assert.NoError(encoder.FinalizeHeader(shard))
+		hdr, err := header.Read(bytes.NewReader(shard.Bytes()))
+		assert.NoError(err)
+		assert.Empty(hdr.PendingFileKey)
+		assert.Empty(hdr.PendingKeyCheck)
+		assert.Empty(hdr.PendingMAC)
+	}
+	reader, err = encoder.NewReadSeeker(newReaders, key2, iv2)
+	assert.NoError(err)
+	output, err = io.ReadAll(reader)
+	assert.NoError(err)
+	assert.Equal(input, output)
+}
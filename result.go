@@ -0,0 +1,88 @@
+package stitch
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/OhanaFS/stitch/header"
+)
+
+// castagnoli is the table used to compute CRC-32C checksums.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// timedWriter adds the time spent writing to the underlying writer to d.
+type timedWriter struct {
+	w io.Writer
+	d *time.Duration
+}
+
+func (t *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.w.Write(p)
+	*t.d += time.Since(start)
+	return n, err
+}
+
+// digestWriter computes the digests of everything written to the underlying
+// writer, and adds the time spent hashing to d.
+type digestWriter struct {
+	w   io.Writer
+	sha hash.Hash
+	crc hash.Hash32
+	d   *time.Duration
+}
+
+func newDigestWriter(w io.Writer, d *time.Duration) *digestWriter {
+	return &digestWriter{w: w, sha: sha256.New(), crc: crc32.New(castagnoli), d: d}
+}
+
+func (w *digestWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	start := time.Now()
+	w.sha.Write(p[:n])
+	w.crc.Write(p[:n])
+	*w.d += time.Since(start)
+	return n, err
+}
+
+// shardResults describes the shards once their complete headers have been
+// written. digests holds the digest writers of the shards if they were hashed
+// as they were written. Otherwise, if the ShardDigests option is set, the
+// shards that were patched in place are read back to compute their digests, and
+// the time spent doing so is added to d.
+func (e *Encoder) shardResults(shards []io.Writer, headers []header.Header,
+	patched []bool, digests []*digestWriter, d *time.Duration) ([]ShardResult, error) {
+	results := make([]ShardResult, len(headers))
+	for i := range headers {
+		results[i] = ShardResult{
+			Index: headers[i].ShardIndex,
+			Size:  shardSize(&headers[i]),
+		}
+
+		if digests != nil {
+			results[i].SHA256 = digests[i].sha.Sum(nil)
+			results[i].CRC32C = digests[i].crc.Sum32()
+			continue
+		}
+		if !e.opts.ShardDigests || !patched[i] {
+			continue
+		}
+		ra, ok := shards[i].(io.ReaderAt)
+		if !ok {
+			continue
+		}
+		start := time.Now()
+		dw := newDigestWriter(io.Discard, new(time.Duration))
+		if _, err := io.Copy(dw, io.NewSectionReader(ra, 0, results[i].Size)); err != nil {
+			return nil, fmt.Errorf("failed to read back shard %d: %v", i, err)
+		}
+		results[i].SHA256 = dw.sha.Sum(nil)
+		results[i].CRC32C = dw.crc.Sum32()
+		*d += time.Since(start)
+	}
+	return results, nil
+}
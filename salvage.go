@@ -0,0 +1,200 @@
+package stitch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+
+	aesgcm "github.com/OhanaFS/stitch/aes"
+	"github.com/OhanaFS/stitch/header"
+	"github.com/OhanaFS/stitch/reedsolomon"
+	"github.com/OhanaFS/stitch/util"
+	"github.com/klauspost/compress/zstd"
+)
+
+var ErrNothingToSalvage = errors.New("no salvageable shards found")
+
+// SalvageResult describes the outcome of Salvage().
+type SalvageResult struct {
+	// Finalized specifies whether the shards had a complete header at their
+	// end, and were finalized. The whole file is then readable as usual.
+	Finalized bool
+	// RecoveredBytes is the number of bytes of the file plaintext written to
+	// the destination.
+	RecoveredBytes uint64
+}
+
+// Salvage recovers the data in shards that weren't finalized because the
+// encode was interrupted. If enough shards have a complete header at their end,
+// they are finalized using FinalizeHeader(), and the whole file is written to
+// dst. Otherwise, the shards are scanned for intact Reed-Solomon blocks, and as
+// much of the start of the file as possible is decrypted, decompressed and
+// written to dst. The recovered data can't be checked against the file hash, as
+// the hash is only written when the encode completes.
+//
+// dst may be nil if only the shards should be finalized.
+func (e *Encoder) Salvage(shards []io.ReadWriteSeeker, dst io.Writer, key, iv []byte) (
+	*SalvageResult, error,
+) {
+	result := &SalvageResult{}
+	readers := make([]io.ReadSeeker, len(shards))
+	for i, shard := range shards {
+		readers[i] = shard
+	}
+
+	// Try to finalize the shards.
+	finalized := 0
+	for _, shard := range shards {
+		if err := e.FinalizeHeader(shard); err == nil {
+			finalized++
+		}
+	}
+	if finalized >= int(e.opts.DataShards) {
+		result.Finalized = true
+		if dst == nil {
+			return result, nil
+		}
+
+		reader, err := e.NewReadSeeker(readers, key, iv)
+		if err != nil {
+			return nil, err
+		}
+		n, err := io.Copy(dst, reader)
+		result.RecoveredBytes = uint64(n)
+		if err != nil {
+			return result, fmt.Errorf("failed to decode data: %w", err)
+		}
+		return result, nil
+	}
+	if dst == nil {
+		return result, nil
+	}
+
+	// Otherwise, read the incomplete headers and recover the data prefix.
+	start := time.Now()
+	hdr, fileKey, shardReaders, err := e.readIncompleteHeaders(readers, key, iv)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reconstruct the intact blocks of encrypted data.
+	encRS, err := reedsolomon.NewEncoder(
+		int(e.opts.DataShards), int(e.opts.ParityShards), hdr.RSBlockSize,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Reed-Solomon encoder: %v", err)
+	}
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		_, err := encRS.JoinPrefix(pw, shardReaders)
+		pw.CloseWithError(err)
+	}()
+	bytesIn := new(int64)
+
+	// Decrypt and decompress the data until the first chunk or frame that is
+	// incomplete. The seek table of the compressed data is never written, so
+	// the frames are decompressed one after the other.
+	rAES, err := aesgcm.NewStreamReader(countingReader{Reader: pr, n: bytesIn}, fileKey, hdr.AESBlockSize, math.MaxUint64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES reader: %v", err)
+	}
+	decZstd, err := zstd.NewReader(rAES, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd reader: %v", err)
+	}
+	defer decZstd.Close()
+
+	progress := e.newProgress(StageSalvage, 0)
+	rProgress := util.NewProgressReader(decZstd, func(n int) {
+		progress.add(int64(n))
+	})
+	w := &salvageWriter{w: dst}
+	_, _ = io.Copy(w, rProgress)
+	progress.finish()
+	e.recordStage(StageSalvage, start, atomic.LoadInt64(bytesIn), int64(w.n))
+	result.RecoveredBytes = w.n
+	if w.err != nil {
+		return result, fmt.Errorf("failed to write data: %w", w.err)
+	}
+
+	return result, nil
+}
+
+// salvageWriter counts the bytes written to the underlying writer, and keeps
+// track of write errors, so that they can be told apart from the expected read
+// errors at the end of the salvaged data.
+type salvageWriter struct {
+	w   io.Writer
+	n   uint64
+	err error
+}
+
+func (s *salvageWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.n += uint64(n)
+	if err != nil {
+		s.err = err
+	}
+	return n, err
+}
+
+// readIncompleteHeaders reads the headers of shards that haven't been
+// finalized, and reconstructs the file key. It returns one of the headers, the
+// file key, and the shards positioned at the start of their data.
+func (e *Encoder) readIncompleteHeaders(shards []io.ReadSeeker, key, iv []byte) (
+	hdr header.Header, fileKey []byte, shardReaders []io.Reader, err error,
+) {
+	totalShards := int(e.opts.DataShards + e.opts.ParityShards)
+
+	// Read the headers, and group them by file.
+	headers := make([]header.Header, len(shards))
+	valid := make([]bool, len(shards))
+	files := make(map[string]int)
+	for i, shard := range shards {
+		h, err := readShardHeader(shard)
+		if err != nil || h.ShardIndex < 0 || h.ShardIndex >= totalShards {
+			continue
+		}
+		headers[i] = *h
+		valid[i] = true
+		files[string(h.FileID)]++
+	}
+	fileID, fileVotes := "", 0
+	for id, n := range files {
+		if n > fileVotes {
+			fileID, fileVotes = id, n
+		}
+	}
+	if fileVotes == 0 {
+		err = ErrNothingToSalvage
+		return
+	}
+
+	// Place the shards of the file, and collect their key shares. The headers
+	// are marked as complete so that their key shares are used.
+	shardReaders = make([]io.Reader, totalShards)
+	var keyHeaders []header.Header
+	for i, h := range headers {
+		if !valid[i] || string(h.FileID) != fileID {
+			continue
+		}
+		if _, e := shards[i].Seek(int64(h.EncodedSize()), io.SeekStart); e != nil {
+			continue
+		}
+		shardReaders[h.ShardIndex] = shards[i]
+		h.IsComplete = true
+		keyHeaders = append(keyHeaders, h)
+		hdr = h
+	}
+
+	// Reconstruct the file key.
+	fileKey, _, err = combineHeaderKeys(keyHeaders, key, iv, int(e.opts.KeyThreshold))
+	if err != nil {
+		err = fmt.Errorf("failed to combine file key pieces: %w", err)
+	}
+	return
+}
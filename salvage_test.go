@@ -0,0 +1,75 @@
+package stitch_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/OhanaFS/stitch"
+	"github.com/OhanaFS/stitch/header"
+	"github.com/OhanaFS/stitch/reedsolomon"
+	"github.com/OhanaFS/stitch/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSalvage(t *testing.T) {
+	assert := assert.New(t)
+
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+	})
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	input := make([]byte, 200000)
+	_, err := rand.Read(input)
+	assert.NoError(err)
+
+	encode := func() []*util.Membuf {
+		shards := make([]*util.Membuf, 3)
+		shardWriters := make([]io.Writer, 3)
+		for i := range shards {
+			shards[i] = util.NewMembuf()
+			// Hide the WriteAt method, so that the headers are left incomplete.
+			shardWriters[i] = struct{ io.Writer }{shards[i]}
+		}
+		_, err := encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+		assert.NoError(err)
+		return shards
+	}
+
+	// Shards that weren't finalized should be finalized.
+	shards := encode()
+	output := &bytes.Buffer{}
+	res, err := encoder.Salvage(
+		[]io.ReadWriteSeeker{shards[0], shards[1], shards[2]}, output, key, iv)
+	assert.NoError(err)
+	assert.True(res.Finalized)
+	assert.Equal(uint64(len(input)), res.RecoveredBytes)
+	assert.Equal(input, output.Bytes())
+
+	// Cut the shards off after a number of blocks, as if the encode was
+	// interrupted, and lose one of them.
+	shards = encode()
+	blocks := 20
+	crashed := make([]io.ReadWriteSeeker, 2)
+	for i := range crashed {
+		b := shards[i].Bytes()[:header.DefaultSize+blocks*(4096+reedsolomon.BlockOverhead)]
+		shard := util.NewMembuf()
+		_, err := shard.Write(b)
+		assert.NoError(err)
+		crashed[i] = shard
+	}
+
+	// The start of the file should be recovered.
+	output.Reset()
+	res, err = encoder.Salvage(crashed, output, key, iv)
+	assert.NoError(err)
+	assert.False(res.Finalized)
+	assert.Greater(res.RecoveredBytes, uint64(blocks*4096))
+	assert.Less(res.RecoveredBytes, uint64(len(input)))
+	assert.Equal(input[:res.RecoveredBytes], output.Bytes())
+}
@@ -0,0 +1,212 @@
+package stitch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/OhanaFS/stitch/header"
+	"github.com/OhanaFS/stitch/reedsolomon"
+)
+
+// A shard that keeps a trailer ends with a copy of the complete header,
+// followed by a locator:
+//
+// | Description                  | Length |
+// | ---------------------------- | ------ |
+// | magic bytes `STITCHtr`       | 8      |
+// | size of the header uint64    | 8      |
+const locatorSize = 16
+
+var (
+	trailerMagic = []byte("STITCHtr")
+
+	errNoTrailer = errors.New("shard has no trailer")
+)
+
+// trailerLocator returns the locator that follows the trailer of the header.
+func trailerLocator(hdr *header.Header) []byte {
+	locator := make([]byte, locatorSize)
+	copy(locator, trailerMagic)
+	binary.LittleEndian.PutUint64(locator[8:], uint64(hdr.EncodedSize()))
+	return locator
+}
+
+// shardSize returns the size of a finalized shard with the given complete
+// header, including its trailer if it keeps one.
+func shardSize(hdr *header.Header) int64 {
+	stripeSize := uint64(hdr.RSBlockSize) * uint64(hdr.DataShards)
+	blocks := (hdr.EncryptedSize + stripeSize - 1) / stripeSize
+	size := int64(hdr.EncodedSize()) +
+		int64(blocks)*int64(hdr.RSBlockSize+reedsolomon.BlockOverhead)
+	if hdr.Trailer {
+		size += int64(hdr.EncodedSize()) + locatorSize
+	}
+	return size
+}
+
+// readShardHeader reads and parses the header at the start of the shard. If it
+// is unreadable, or if the shard was written in streaming mode, the trailer at
+// the end of the shard is used instead, if there is one.
+func readShardHeader(shard io.ReadSeeker) (*header.Header, error) {
+	// Seek to the beginning of the shard.
+	if _, err := shard.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek to beginning of shard: %v", err)
+	}
+
+	// Read and parse the header.
+	hdr, err := header.Read(shard)
+	if err != nil {
+		// Fall back to the trailer.
+		if trailer, e := readShardTrailer(shard); e == nil {
+			return trailer, nil
+		}
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	// Shards written in streaming mode have their complete header at the end.
+	if !hdr.IsComplete && hdr.Footer {
+		if trailer, e := readShardTrailer(shard); e == nil {
+			return trailer, nil
+		}
+	}
+
+	return hdr, nil
+}
+
+// readShardTrailer reads and parses the copy of the complete header at the end
+// of the shard.
+func readShardTrailer(shard io.ReadSeeker) (*header.Header, error) {
+	// Read the locator.
+	if _, err := shard.Seek(-locatorSize, io.SeekEnd); err != nil {
+		return nil, errNoTrailer
+	}
+	locator := make([]byte, locatorSize)
+	if _, err := io.ReadFull(shard, locator); err != nil {
+		return nil, errNoTrailer
+	}
+	if !bytes.Equal(locator[:8], trailerMagic) {
+		return nil, errNoTrailer
+	}
+	size := binary.LittleEndian.Uint64(locator[8:])
+	if size > header.MaxSize {
+		return nil, errNoTrailer
+	}
+
+	// Read the header.
+	if _, err := shard.Seek(-int64(size)-locatorSize, io.SeekEnd); err != nil {
+		return nil, errNoTrailer
+	}
+	hdr, err := header.Read(shard)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trailer: %w", err)
+	}
+	if !hdr.IsComplete || !hdr.Trailer {
+		return nil, errNoTrailer
+	}
+
+	return hdr, nil
+}
+
+// trailerReader reads a shard written in streaming mode, holding back the
+// trailer at its end. The trailer is only known to be the trailer once the end
+// of the shard is reached, so enough of the shard is read ahead to keep it out
+// of the data.
+type trailerReader struct {
+	r    io.Reader
+	size int
+	buf  []byte
+	err  error
+}
+
+// Assert that trailerReader implements the io.Reader interface.
+var _ io.Reader = &trailerReader{}
+
+// newTrailerReader returns a trailerReader for a shard whose leading header is
+// hdr. The trailer has the same size as the leading header.
+func newTrailerReader(r io.Reader, hdr *header.Header) *trailerReader {
+	return &trailerReader{r: r, size: hdr.EncodedSize() + locatorSize}
+}
+
+func (t *trailerReader) Read(p []byte) (int, error) {
+	// Read ahead so that the buffer holds the trailer on top of the data to be
+	// returned.
+	for len(t.buf) < t.size+len(p) && t.err == nil {
+		start := len(t.buf)
+		t.buf = append(t.buf, make([]byte, t.size+len(p)-start)...)
+		var n int
+		n, t.err = t.r.Read(t.buf[start:])
+		t.buf = t.buf[:start+n]
+	}
+
+	available := len(t.buf) - t.size
+	if available <= 0 {
+		return 0, t.err
+	}
+	n := copy(p, t.buf[:available])
+	t.buf = append(t.buf[:0], t.buf[n:]...)
+	return n, nil
+}
+
+// trailer parses the trailer that was held back, once the shard has been read
+// to the end.
+func (t *trailerReader) trailer() (*header.Header, error) {
+	// The end of the shard may not have been reached yet if it was read up to
+	// its last block, and it shouldn't have any data left.
+	if t.err == nil {
+		if n, _ := t.Read(make([]byte, 1)); n > 0 {
+			return nil, errNoTrailer
+		}
+	}
+	if t.err != io.EOF || len(t.buf) != t.size {
+		return nil, errNoTrailer
+	}
+	locator := t.buf[t.size-locatorSize:]
+	if !bytes.Equal(locator[:8], trailerMagic) ||
+		binary.LittleEndian.Uint64(locator[8:]) != uint64(t.size-locatorSize) {
+		return nil, errNoTrailer
+	}
+
+	hdr, err := header.Read(bytes.NewReader(t.buf))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trailer: %w", err)
+	}
+	if !hdr.IsComplete || !hdr.Trailer {
+		return nil, errNoTrailer
+	}
+
+	return hdr, nil
+}
+
+// writeShardHeader encodes the header and writes it to the start of the shard.
+// If the shard keeps a trailer, it is updated as well.
+func writeShardHeader(shard io.WriteSeeker, hdr *header.Header) error {
+	b, err := hdr.Encode()
+	if err != nil {
+		return fmt.Errorf("failed to encode header: %w", err)
+	}
+
+	// Seek to the beginning of the shard.
+	if _, err := shard.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek to beginning of shard: %v", err)
+	}
+
+	// Write the new header.
+	if _, err := shard.Write(b); err != nil {
+		return fmt.Errorf("failed to write header: %v", err)
+	}
+
+	// Write the trailer.
+	if hdr.Trailer {
+		if _, err := shard.Seek(-int64(len(b))-locatorSize, io.SeekEnd); err != nil {
+			return fmt.Errorf("failed to seek to trailer: %v", err)
+		}
+		if _, err := shard.Write(b); err != nil {
+			return fmt.Errorf("failed to write trailer: %v", err)
+		}
+	}
+
+	return nil
+}
@@ -2,13 +2,21 @@
 // shards.
 package stitch
 
-import "errors"
+import (
+	"errors"
+	"time"
+
+	"github.com/OhanaFS/stitch/header"
+)
 
 const (
 	// rsBlockSize is the size of a Reed-Solomon block.
 	rsBlockSize = 4096
 	// aesBlockSize is the size of a chunk of data that is encrypted with AES-GCM.
 	aesBlockSize = 1024
+	// fileIDSize is the size of the random ID that ties the shards of a file
+	// together.
+	fileIDSize = 16
 )
 
 var (
@@ -17,6 +25,17 @@ var (
 	ErrNotEnoughKeyShards = errors.New("not enough shards to reconstruct the file key")
 	ErrNotEnoughShards    = errors.New("not enough shards to reconstruct the file")
 	ErrNoCompleteHeader   = errors.New("no complete header found")
+	ErrWrongKey           = errors.New("wrong key supplied for the file")
+	ErrCorruptKeyShares   = errors.New("key shares are corrupted")
+	ErrHashMismatch       = errors.New("decoded data does not match the file hash")
+
+	ErrShardFromDifferentFile = errors.New("shards belong to different files")
+	ErrMetadataTooLarge       = errors.New("metadata does not fit in the header")
+	ErrInvalidPadding         = errors.New("PaddingMultiple requires a non-zero multiple")
+
+	ErrKeyRotationInProgress = errors.New("a key rotation is already in progress")
+	ErrKeyRotationIncomplete = errors.New("key rotation was not prepared on every shard")
+	ErrKeyRotationCommitted  = errors.New("key rotation has already been committed")
 )
 
 // EncoderOptions specifies options for the Encoder.
@@ -30,6 +49,53 @@ type EncoderOptions struct {
 	// KeyThreshold is the minimum number of shards required to reconstruct the
 	// key used to encrypt the data.
 	KeyThreshold uint8
+	// Padding is the policy used to pad the data before it is encrypted, in
+	// order to hide its size. Defaults to PaddingNone.
+	Padding PaddingPolicy
+	// PaddingMultiple is the multiple to pad the data to when Padding is
+	// PaddingMultiple. It must not be zero in that case.
+	PaddingMultiple uint64
+	// Generation is stored in the header of every shard, and can be used to tell
+	// apart different versions of the same file, e.g. a version number.
+	Generation uint64
+	// Metadata describes the file being encoded. It is encrypted with the file
+	// key and stored in the header of each shard, and can be read back using
+	// ReadMetadata(). It is used for every file encoded with the Encoder, use
+	// EncodeWithMetadata() to supply the metadata of each file instead.
+	Metadata *header.Metadata
+	// KeepTrailer keeps a copy of the complete header at the end of each shard
+	// after it is finalized, which is used if the header at the start of the
+	// shard is corrupted.
+	KeepTrailer bool
+	// Streaming makes Encode() produce shards that are final as soon as they are
+	// written, so that they can be written to writers that don't support
+	// seeking, such as pipes or uploads. The header at the start of each shard
+	// is left incomplete, and the complete header is written to the end of the
+	// shard, where it is found by the decoder. FinalizeHeader() isn't needed.
+	Streaming bool
+	// Progress is called periodically with the progress of encoding, decoding,
+	// verifying, rekeying and salvaging. No progress is reported if it is nil.
+	Progress ProgressFunc
+	// Logger receives events such as missing shards, corrected blocks and
+	// headers that disagree with each other. Events are discarded if it is nil.
+	Logger Logger
+	// Metrics receives measurements such as the bytes processed and the time
+	// taken by each stage. Measurements are discarded if it is nil.
+	Metrics Metrics
+	// ShardDigests makes Encode() compute the SHA-256 and CRC-32C digests of
+	// each finalized shard, and return them in the EncodingResult. In streaming
+	// mode, the shards are final as they are written, so the digests are
+	// computed on the fly. Otherwise, they are only computed for shards that
+	// have their header patched in place and that can be read back, as
+	// io.ReaderAt, such as *os.File, which requires reading them once more.
+	ShardDigests bool
+	// Digests lists additional digests of the input to compute while encoding,
+	// which are returned in the EncodingResult.
+	Digests []DigestAlgorithm
+	// StoreDigests stores the additional digests in the header of each shard,
+	// sealed with the file key. They can be read back using ReadDigests(), and
+	// the data is checked against them by Decode().
+	StoreDigests bool
 }
 
 // Encoder takes in a stream of data and shards it into a specified number of
@@ -59,6 +125,58 @@ type EncodingResult struct {
 	FileSize uint64
 	// FileHash is the SHA256 hash of the input file.
 	FileHash []byte
+	// FileID is the random ID that ties the shards together.
+	FileID []byte
+	// CompressedSize is the size of the file after compression, before it is
+	// padded.
+	CompressedSize uint64
+	// EncryptedSize is the size of the encrypted data that is split across the
+	// shards.
+	EncryptedSize uint64
+	// Shards describes each shard, in the order of the shard writers.
+	Shards []ShardResult
+	// Timings contains the time spent in each stage of the pipeline.
+	Timings StageTimings
+	// Digests contains the additional digests of the input that were requested
+	// in the encoder options.
+	Digests map[DigestAlgorithm][]byte
+}
+
+// ShardResult describes a shard written by the encoder.
+type ShardResult struct {
+	// Index is the index of the shard.
+	Index int
+	// Size is the size of the shard once it is finalized, in bytes.
+	Size int64
+	// SHA256 is the SHA-256 digest of the finalized shard. It is only set if
+	// the ShardDigests option is set, and the shard is final once it is
+	// encoded. See EncoderOptions.ShardDigests.
+	SHA256 []byte
+	// CRC32C is the CRC-32C checksum of the finalized shard, using the
+	// Castagnoli polynomial. It is only valid if SHA256 is set.
+	CRC32C uint32
+}
+
+// StageTimings contains the time spent in each stage of the pipeline. The
+// stages run interleaved, so each duration only counts the time spent in that
+// stage, excluding the time spent passing its output to the next one. Stages
+// that don't apply are left as zero.
+type StageTimings struct {
+	// Read is the time spent reading the input.
+	Read time.Duration
+	// Hash is the time spent hashing the input and the shards.
+	Hash time.Duration
+	// Compress is the time spent compressing the data.
+	Compress time.Duration
+	// Encrypt is the time spent encrypting the data.
+	Encrypt time.Duration
+	// ErasureCode is the time spent splitting the data and computing the
+	// parity with Reed-Solomon.
+	ErasureCode time.Duration
+	// Write is the time spent writing the shards, including their headers.
+	Write time.Duration
+	// Total is the time taken by the whole encode.
+	Total time.Duration
 }
 
 func NewEncoder(opts *EncoderOptions) *Encoder {
@@ -0,0 +1,58 @@
+package util
+
+import (
+	"context"
+	"io"
+)
+
+// ContextReader wraps an io.Reader and stops reading once the context is done,
+// returning the context's error.
+type ContextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+// Assert that the ContextReader struct satisfies the io.Reader interface.
+var _ io.Reader = &ContextReader{}
+
+// NewContextReader creates a new ContextReader.
+func NewContextReader(ctx context.Context, reader io.Reader) *ContextReader {
+	return &ContextReader{ctx: ctx, reader: reader}
+}
+
+func (r *ContextReader) Read(p []byte) (n int, err error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// ContextReadSeeker wraps an io.ReadSeeker and stops reading and seeking once
+// the context is done, returning the context's error.
+type ContextReadSeeker struct {
+	ctx    context.Context
+	reader io.ReadSeeker
+}
+
+// Assert that the ContextReadSeeker struct satisfies the io.ReadSeeker
+// interface.
+var _ io.ReadSeeker = &ContextReadSeeker{}
+
+// NewContextReadSeeker creates a new ContextReadSeeker.
+func NewContextReadSeeker(ctx context.Context, reader io.ReadSeeker) *ContextReadSeeker {
+	return &ContextReadSeeker{ctx: ctx, reader: reader}
+}
+
+func (r *ContextReadSeeker) Read(p []byte) (n int, err error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+func (r *ContextReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Seek(offset, whence)
+}
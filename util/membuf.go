@@ -12,8 +12,11 @@ type Membuf struct {
 	length int
 }
 
-// Assert that the Membuf struct satisfies the io.ReadWriteSeeker interface.
+// Assert that the Membuf struct satisfies the io.ReadWriteSeeker, io.ReaderAt
+// and io.WriterAt interfaces.
 var _ io.ReadWriteSeeker = &Membuf{}
+var _ io.ReaderAt = &Membuf{}
+var _ io.WriterAt = &Membuf{}
 
 // NewMembuf creates a new Membuf.
 func NewMembuf() *Membuf {
@@ -34,19 +37,67 @@ func (m *Membuf) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
-func (m *Membuf) Write(p []byte) (n int, err error) {
-	for m.pos+len(p) > len(m.buf) {
-		// Allocate double the size of the buffer if the write would overflow.
-		newbuf := make([]byte, len(m.buf)*2)
-		copy(newbuf, m.buf)
-		m.buf = newbuf
+// grow makes sure the buffer can hold size bytes, at least doubling its size if
+// it can't.
+func (m *Membuf) grow(size int) {
+	if size <= len(m.buf) {
+		return
 	}
+	newbuf := make([]byte, Max(size, len(m.buf)*2))
+	copy(newbuf, m.buf)
+	m.buf = newbuf
+}
+
+func (m *Membuf) Write(p []byte) (n int, err error) {
+	m.grow(m.pos + len(p))
 	n = copy(m.buf[m.pos:], p)
 	m.pos += n
 	m.length = Max(m.length, m.pos)
 	return len(p), nil
 }
 
+// ReadAt reads into p from the given offset, without changing the position of
+// the buffer.
+func (m *Membuf) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+	if off >= int64(m.length) {
+		return 0, io.EOF
+	}
+	n = copy(p, m.buf[off:m.length])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes p at the given offset, without changing the position of the
+// buffer.
+func (m *Membuf) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+	pos := m.pos
+	m.pos = int(off)
+	n, err = m.Write(p)
+	m.pos = pos
+	return n, err
+}
+
+// Truncate changes the length of the buffer.
+func (m *Membuf) Truncate(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("negative size: %d", size)
+	}
+	m.grow(int(size))
+	for i := m.length; i < int(size); i++ {
+		m.buf[i] = 0
+	}
+	m.length = int(size)
+	return nil
+}
+
 func (m *Membuf) Seek(offset int64, whence int) (int64, error) {
 	switch whence {
 	case io.SeekStart:
@@ -0,0 +1,38 @@
+package util_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/OhanaFS/stitch/util"
+)
+
+func TestMembufEmpty(t *testing.T) {
+	assert := assert.New(t)
+
+	// Buffers without any space allocated should grow when written to or
+	// truncated to a larger size.
+	for _, m := range []*util.Membuf{{}, util.NewMembufN(0)} {
+		assert.NoError(m.Truncate(10))
+		assert.Equal(make([]byte, 10), m.Bytes())
+
+		_, err := m.Seek(0, io.SeekEnd)
+		assert.NoError(err)
+		n, err := m.Write([]byte("hello"))
+		assert.NoError(err)
+		assert.Equal(5, n)
+		assert.Equal(15, m.Len())
+
+		assert.NoError(m.Truncate(2000))
+		assert.Equal(2000, m.Len())
+		assert.Equal([]byte("hello"), m.Bytes()[10:15])
+	}
+
+	m := util.NewMembufN(0)
+	n, err := m.WriteAt([]byte("hello"), 3)
+	assert.NoError(err)
+	assert.Equal(5, n)
+	assert.Equal([]byte("\x00\x00\x00hello"), m.Bytes())
+}
@@ -2,9 +2,11 @@ package stitch
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/OhanaFS/stitch/header"
 )
@@ -23,6 +25,12 @@ type VerificationResult struct {
 	// IrrecoverableBlocks is a slice of block indices that have fewer healthy
 	// shards than is required to recover.
 	IrrecoverableBlocks []int
+	// SuspectShards is a slice of indices of the input shards with headers that
+	// disagree with the headers of the other shards.
+	SuspectShards []int
+	// ForeignShards is a slice of indices of the input shards that belong to a
+	// different file.
+	ForeignShards []int
 }
 
 type ShardVerificationResult struct {
@@ -59,8 +67,26 @@ func roundUpMult(num, multiple int) int {
 }
 
 // VerifyShardIntegrity tries to read through an entire shard, and report back
-// any issues. If the shard is unreadable, an error will be returned.
+// any issues. If the shard is unreadable, an error will be returned. Shards
+// written in streaming mode can only be verified if the shard is also an
+// io.Seeker, as their complete header is at the end of the shard.
 func VerifyShardIntegrity(shard io.Reader) (*ShardVerificationResult, error) {
+	return VerifyShardIntegrityContext(context.Background(), shard)
+}
+
+// VerifyShardIntegrityContext is like VerifyShardIntegrity, but stops once the
+// context is done, returning the context's error.
+func VerifyShardIntegrityContext(ctx context.Context, shard io.Reader) (
+	*ShardVerificationResult, error,
+) {
+	return verifyShard(ctx, shard, nil)
+}
+
+// verifyShard verifies a shard, adding the number of bytes read to the
+// progress.
+func verifyShard(ctx context.Context, shard io.Reader, progress *progressTracker) (
+	*ShardVerificationResult, error,
+) {
 	result := &ShardVerificationResult{
 		BrokenBlocks: []int{},
 	}
@@ -71,30 +97,54 @@ func VerifyShardIntegrity(shard io.Reader) (*ShardVerificationResult, error) {
 	}
 
 	// Read the header
-	headerBuf := make([]byte, header.HeaderSize)
-	hdr := &header.Header{}
-	if _, err := shard.Read(headerBuf); err != nil {
+	hdr, err := header.Read(shard)
+	if err != nil {
 		return nil, fmt.Errorf("failed to read header: %w", err)
 	}
 	result.IsAvailable = true
+	progress.add(int64(hdr.EncodedSize()))
 
-	if err := hdr.Decode(headerBuf); err != nil {
-		return nil, fmt.Errorf("failed to decode header: %w", err)
+	// Use the complete header at the end of shards written in streaming mode.
+	if rs, ok := shard.(io.ReadSeeker); ok && !hdr.IsComplete && hdr.Footer {
+		trailer, err := readShardTrailer(rs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read trailer: %w", err)
+		}
+		if _, err := rs.Seek(int64(trailer.EncodedSize()), io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to seek to data: %w", err)
+		}
+		hdr = trailer
 	}
 	result.IsHeaderComplete = true
 
 	result.ShardIndex = hdr.ShardIndex
-	totalBlocksAcrossAllShards := 1 + int(hdr.EncryptedSize/uint64(hdr.RSBlockSize))
-	result.BlocksCount = roundUpMult(
-		totalBlocksAcrossAllShards/hdr.ShardCount,
-		hdr.ShardCount,
-	)
+	if hdr.DataShards > 0 {
+		stripeSize := uint64(hdr.RSBlockSize * hdr.DataShards)
+		result.BlocksCount = int((hdr.EncryptedSize + stripeSize - 1) / stripeSize)
+	} else {
+		totalBlocksAcrossAllShards := 1 + int(hdr.EncryptedSize/uint64(hdr.RSBlockSize))
+		result.BlocksCount = roundUpMult(
+			totalBlocksAcrossAllShards/hdr.ShardCount,
+			hdr.ShardCount,
+		)
+	}
 
 	// Read each chunk
 	block := make([]byte, hdr.RSBlockSize)
 	hash := make([]byte, sha256.Size)
 	iBlk := 0
 	for {
+		// Stop if the context is done.
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// Stop at the end of the data if the exact number of blocks is known, as
+		// the shard may end with a trailer.
+		if hdr.IsComplete && hdr.DataShards > 0 && iBlk == result.BlocksCount {
+			break
+		}
+
 		// Read block and hash
 		if _, err := shard.Read(block); err != nil {
 			if err == io.EOF {
@@ -119,6 +169,7 @@ func VerifyShardIntegrity(shard io.Reader) (*ShardVerificationResult, error) {
 		// Update the count of blocks found
 		iBlk += 1
 		result.BlocksFound = iBlk
+		progress.add(int64(len(block) + len(hash)))
 	}
 
 	return result, nil
@@ -128,6 +179,14 @@ func VerifyShardIntegrity(shard io.Reader) (*ShardVerificationResult, error) {
 // shards. An error is returned if it is not possible to recover the original
 // file.
 func (e *Encoder) VerifyIntegrity(shards []io.ReadSeeker) (*VerificationResult, error) {
+	return e.VerifyIntegrityContext(context.Background(), shards)
+}
+
+// VerifyIntegrityContext is like VerifyIntegrity, but stops once the context is
+// done, returning the context's error.
+func (e *Encoder) VerifyIntegrityContext(ctx context.Context, shards []io.ReadSeeker) (
+	*VerificationResult, error,
+) {
 	totalShards := int(e.opts.DataShards + e.opts.ParityShards)
 	result := &VerificationResult{
 		TotalShards:   totalShards,
@@ -141,6 +200,16 @@ func (e *Encoder) VerifyIntegrity(shards []io.ReadSeeker) (*VerificationResult,
 		return nil, ErrNotEnoughShards
 	}
 
+	// Add up the size of the shards to report progress against.
+	start := time.Now()
+	total := int64(0)
+	for _, shard := range shards {
+		if size, err := shard.Seek(0, io.SeekEnd); err == nil {
+			total += size
+		}
+	}
+	progress := e.newProgress(StageVerify, total)
+
 	totalBlocks := 0
 	missingCount := 0
 	shardResults := make([]*ShardVerificationResult, totalShards)
@@ -151,7 +220,10 @@ func (e *Encoder) VerifyIntegrity(shards []io.ReadSeeker) (*VerificationResult,
 		}
 
 		// Verify each shard individually
-		res, err := VerifyShardIntegrity(shard)
+		res, err := verifyShard(ctx, shard, progress)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
 		if err != nil {
 			missingCount++
 			result.AllGood = false
@@ -170,6 +242,15 @@ func (e *Encoder) VerifyIntegrity(shards []io.ReadSeeker) (*VerificationResult,
 		return nil, ErrNotEnoughShards
 	}
 
+	// Cross-check the headers of the shards
+	if _, _, _, suspect, foreign, err := readHeader(shards, totalShards); err == nil {
+		result.SuspectShards = suspect
+		result.ForeignShards = foreign
+		if len(suspect) > 0 || len(foreign) > 0 {
+			result.AllGood = false
+		}
+	}
+
 	// Check if the shards have any issues
 	for _, res := range shardResults {
 		if res == nil {
@@ -216,6 +297,19 @@ func (e *Encoder) VerifyIntegrity(shards []io.ReadSeeker) (*VerificationResult,
 			result.FullyReadable = false
 		}
 	}
+	progress.finish()
+
+	// Record the measurements of the stage.
+	e.recordStage(StageVerify, start, total, 0)
+	corruptBlocks := 0
+	for _, res := range shardResults {
+		if res != nil {
+			corruptBlocks += len(res.BrokenBlocks)
+		}
+	}
+	e.metrics().AddCounter(MetricCorruptBlocks, StageVerify, float64(corruptBlocks))
+	e.metrics().AddCounter(MetricIrrecoverableBlocks, StageVerify,
+		float64(len(result.IrrecoverableBlocks)))
 
 	return result, nil
 }
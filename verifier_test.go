@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/OhanaFS/stitch"
+	"github.com/OhanaFS/stitch/header"
 	"github.com/OhanaFS/stitch/util"
 	"github.com/stretchr/testify/assert"
 )
@@ -73,11 +74,11 @@ func TestVerify(t *testing.T) {
 	}
 
 	// Damage the shards
-	_, err = shards[1].Seek(1024, io.SeekStart) // Block 0
+	_, err = shards[1].Seek(header.DefaultSize+512, io.SeekStart) // Block 0
 	assert.NoError(err)
 	_, err = shards[1].Write([]byte("blah"))
 	assert.NoError(err)
-	_, err = shards[1].Seek(12345, io.SeekStart) // Block 2
+	_, err = shards[1].Seek(header.DefaultSize+11833, io.SeekStart) // Block 2
 	assert.NoError(err)
 	_, err = shards[1].Write([]byte("asdf"))
 	assert.NoError(err)
@@ -104,11 +105,11 @@ func TestVerify(t *testing.T) {
 	assert.Equal(0, len(vires.IrrecoverableBlocks))
 
 	// Damage another shard
-	_, err = shards[2].Seek(1024, io.SeekStart) // Block 0
+	_, err = shards[2].Seek(header.DefaultSize+512, io.SeekStart) // Block 0
 	assert.NoError(err)
 	_, err = shards[2].Write([]byte("blah"))
 	assert.NoError(err)
-	_, err = shards[2].Seek(8192, io.SeekStart) // Block 1
+	_, err = shards[2].Seek(header.DefaultSize+7680, io.SeekStart) // Block 1
 	assert.NoError(err)
 	_, err = shards[2].Write([]byte("blah"))
 	assert.NoError(err)
@@ -155,3 +156,58 @@ func TestVerify(t *testing.T) {
 	assert.Equal(3, len(vires.ByShard))
 	assert.Equal([]int{0}, vires.IrrecoverableBlocks)
 }
+
+func TestHeaderConsensus(t *testing.T) {
+	assert := assert.New(t)
+
+	input := make([]byte, 10000)
+	_, err := rand.Read(input)
+	assert.NoError(err)
+
+	shards := make([]*util.Membuf, 3)
+	shardWriters := make([]io.Writer, 3)
+	shardReaders := make([]io.ReadSeeker, 3)
+	for i := 0; i < 3; i++ {
+		shards[i] = util.NewMembuf()
+		shardWriters[i] = shards[i]
+		shardReaders[i] = shards[i]
+	}
+
+	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   2,
+		ParityShards: 1,
+		KeyThreshold: 2,
+	})
+	key := []byte("11111111222222223333333344444444")
+	iv := []byte("1234567890ab")
+
+	_, err = encoder.Encode(bytes.NewReader(input), shardWriters, key, iv)
+	assert.NoError(err)
+	for _, shard := range shards {
+		assert.NoError(encoder.FinalizeHeader(shard))
+	}
+
+	// Rewrite the last header so that it disagrees with the others.
+	hdr := header.NewHeader()
+	assert.NoError(hdr.Decode(shards[2].Bytes()))
+	hdr.EncryptedSize += 4096
+	b, err := hdr.Encode()
+	assert.NoError(err)
+	_, err = shards[2].Seek(0, io.SeekStart)
+	assert.NoError(err)
+	_, err = shards[2].Write(b)
+	assert.NoError(err)
+
+	// The shard should be flagged as suspect.
+	vres, err := encoder.VerifyIntegrity(shardReaders)
+	assert.NoError(err)
+	assert.False(vres.AllGood)
+	assert.Equal([]int{2}, vres.SuspectShards)
+
+	// The data should still be decoded using the majority header.
+	reader, err := encoder.NewReadSeeker(shardReaders, key, iv)
+	assert.NoError(err)
+	output, err := io.ReadAll(reader)
+	assert.NoError(err)
+	assert.Equal(input, output)
+}